@@ -2,6 +2,9 @@ module github.com/yiblet/stampy
 
 go 1.24.2
 
-require github.com/alexflint/go-arg v1.6.0
+require (
+	github.com/BurntSushi/toml v1.6.0
+	github.com/alexflint/go-arg v1.6.0
+)
 
 require github.com/alexflint/go-scalar v1.2.0 // indirect
@@ -0,0 +1,215 @@
+package internal
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// FileConfig holds the settings read from a stampy config file. They are
+// defaults: flags and STAMPY_* environment variables override them.
+type FileConfig struct {
+	Template string
+	JSON     string
+	TZ       string
+	Locale   string
+	Color    string
+	Presets  map[string]Preset
+}
+
+// projectConfigName is the per-project config file, looked up from the working
+// directory towards the root.
+const projectConfigName = ".stampy.toml"
+
+// UserConfigPath is the per-user config file: $STAMPY_CONFIG when set, else
+// $XDG_CONFIG_HOME/stampy/config.toml, falling back to ~/.config/stampy/config.toml.
+func UserConfigPath() (string, error) {
+	if path := os.Getenv("STAMPY_CONFIG"); path != "" {
+		return path, nil
+	}
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "stampy", "config.toml"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("locate config file: %w", err)
+	}
+	return filepath.Join(home, ".config", "stampy", "config.toml"), nil
+}
+
+// rawConfig mirrors the TOML layout. Presets are decoded loosely because each
+// may be a bare template string or a table with template, json and description.
+type rawConfig struct {
+	Template string         `toml:"template"`
+	JSON     string         `toml:"json"`
+	TZ       string         `toml:"tz"`
+	Locale   string         `toml:"locale"`
+	Color    string         `toml:"color"`
+	Presets  map[string]any `toml:"presets"`
+}
+
+// ProjectConfigPath returns the nearest .stampy.toml in dir or one of its
+// parents, or "" when there is none.
+func ProjectConfigPath(dir string) string {
+	for {
+		path := filepath.Join(dir, projectConfigName)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// LoadConfig reads the user config file and then the project config file found
+// from dir, whose settings and presets take precedence.
+func LoadConfig(dir string) (FileConfig, error) {
+	var cfg FileConfig
+	// Without a home directory there is simply no user config.
+	if path, err := UserConfigPath(); err == nil {
+		if cfg, err = LoadConfigFile(path); err != nil {
+			return FileConfig{}, err
+		}
+	}
+	if path := ProjectConfigPath(dir); path != "" {
+		project, err := LoadConfigFile(path)
+		if err != nil {
+			return FileConfig{}, err
+		}
+		cfg = cfg.merge(project)
+	}
+	return cfg, nil
+}
+
+// merge overlays the settings and presets set in over onto c.
+func (c FileConfig) merge(over FileConfig) FileConfig {
+	c.Template = cmp.Or(over.Template, c.Template)
+	c.JSON = cmp.Or(over.JSON, c.JSON)
+	c.TZ = cmp.Or(over.TZ, c.TZ)
+	c.Locale = cmp.Or(over.Locale, c.Locale)
+	c.Color = cmp.Or(over.Color, c.Color)
+	if len(over.Presets) > 0 {
+		presets := make(map[string]Preset, len(c.Presets)+len(over.Presets))
+		maps.Copy(presets, c.Presets)
+		maps.Copy(presets, over.Presets)
+		c.Presets = presets
+	}
+	return c
+}
+
+// ApplyConfig fills the options that the command line and environment left
+// unset from cfg. NoJSON clears any JSON key, including one from STAMPY_JSON.
+func ApplyConfig(opts Options, cfg FileConfig) Options {
+	if !opts.TemplateProvided && cfg.Template != "" {
+		opts.Template = cfg.Template
+		opts.TemplateProvided = true
+	}
+	if opts.NoJSON {
+		opts.JSONKey = ""
+	} else if opts.JSONKey == "" {
+		opts.JSONKey = cfg.JSON
+	}
+	if opts.TZ == "" {
+		opts.TZ = cfg.TZ
+	}
+	if opts.Locale == "" {
+		opts.Locale = cfg.Locale
+	}
+	if opts.Color == "" {
+		opts.Color = cfg.Color
+	}
+	opts.Presets = cfg.Presets
+	return opts
+}
+
+// NeedsConfig reports whether opts take their template from the config files:
+// no template was given, or it names a @preset. Only then must a config file
+// that fails to load stop the run.
+func NeedsConfig(opts Options) bool {
+	if !opts.TemplateProvided {
+		return true
+	}
+	_, ok := presetRef(opts.Template)
+	return ok
+}
+
+// LoadConfigFile reads a TOML config file. A missing file is not an error and
+// yields an empty config.
+func LoadConfigFile(path string) (FileConfig, error) {
+	var raw rawConfig
+	meta, err := toml.DecodeFile(path, &raw)
+	if errors.Is(err, fs.ErrNotExist) {
+		return FileConfig{}, nil
+	}
+	if err != nil {
+		return FileConfig{}, fmt.Errorf("read config %s: %w", path, err)
+	}
+	// Keys inside [presets] are checked by decodePreset.
+	for _, key := range meta.Undecoded() {
+		if key[0] != "presets" {
+			return FileConfig{}, fmt.Errorf("config %s: unknown setting '%s'", path, key)
+		}
+	}
+
+	cfg := FileConfig{Template: raw.Template, JSON: raw.JSON, TZ: raw.TZ, Locale: raw.Locale, Color: raw.Color}
+	if len(raw.Presets) > 0 {
+		cfg.Presets = make(map[string]Preset, len(raw.Presets))
+	}
+	for name, value := range raw.Presets {
+		preset, err := decodePreset(value)
+		if err != nil {
+			return FileConfig{}, fmt.Errorf("config %s: preset '%s': %w", path, name, err)
+		}
+		cfg.Presets[name] = preset
+	}
+	return cfg, nil
+}
+
+// decodePreset accepts either `name = "template"` or a table with template,
+// json and description keys.
+func decodePreset(value any) (Preset, error) {
+	switch v := value.(type) {
+	case string:
+		return Preset{Template: v}, nil
+	case map[string]any:
+		var preset Preset
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			text, ok := v[key].(string)
+			if !ok {
+				return Preset{}, fmt.Errorf("'%s' must be a string", key)
+			}
+			switch key {
+			case "template":
+				preset.Template = text
+			case "json":
+				preset.JSONKey = text
+			case "description":
+				preset.Description = text
+			default:
+				return Preset{}, fmt.Errorf("unknown key '%s' (want template, json or description)", key)
+			}
+		}
+		if strings.TrimSpace(preset.Template) == "" {
+			return Preset{}, fmt.Errorf("missing template")
+		}
+		return preset, nil
+	default:
+		return Preset{}, fmt.Errorf("want a template string or a table with a template")
+	}
+}
@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	content := `[presets]
+deploy = "{iso} {host} {}"
+
+[presets.api]
+template = "{iso}"
+json = "time"
+description = "API logs"
+`
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfigFile(path)
+	if err != nil {
+		t.Fatalf("LoadConfigFile returned error: %v", err)
+	}
+	want := map[string]Preset{
+		"deploy": {Template: "{iso} {host} {}"},
+		"api":    {Template: "{iso}", JSONKey: "time", Description: "API logs"},
+	}
+	if !reflect.DeepEqual(cfg.Presets, want) {
+		t.Fatalf("unexpected presets: got %+v want %+v", cfg.Presets, want)
+	}
+}
+
+func TestLoadConfigFileMissing(t *testing.T) {
+	cfg, err := LoadConfigFile(filepath.Join(t.TempDir(), "absent.toml"))
+	if err != nil || cfg.Presets != nil {
+		t.Fatalf("expected empty config for missing file, got %+v, %v", cfg, err)
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	tests := map[string]string{
+		"unknown setting":    "colour = \"always\"\n",
+		"unknown preset key": "[presets.api]\ntemplate = \"{iso}\"\nkey = \"ts\"\n",
+		"missing template":   "[presets.api]\njson = \"ts\"\n",
+		"wrong type":         "[presets]\napi = 3\n",
+		"syntax":             "[presets\n",
+	}
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.toml")
+			if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := LoadConfigFile(path)
+			if err == nil || !strings.Contains(err.Error(), path) {
+				t.Fatalf("expected error naming %s, got %v", path, err)
+			}
+		})
+	}
+}
+
+func TestUserConfigPath(t *testing.T) {
+	t.Setenv("STAMPY_CONFIG", "")
+	t.Setenv("XDG_CONFIG_HOME", "/tmp/xdg")
+	path, err := UserConfigPath()
+	if err != nil || path != "/tmp/xdg/stampy/config.toml" {
+		t.Fatalf("unexpected path %q, %v", path, err)
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	userDir, projectDir := t.TempDir(), t.TempDir()
+	userPath := filepath.Join(userDir, "config.toml")
+	write := func(path, content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(userPath, "template = \"{line} {}\"\ntz = \"UTC\"\n[presets]\nmine = \"U {}\"\nshared = \"user {}\"\n")
+	write(filepath.Join(projectDir, projectConfigName), "tz = \"Asia/Tokyo\"\nlocale = \"ja\"\ncolor = \"never\"\n[presets]\nshared = \"project {}\"\n")
+	nested := filepath.Join(projectDir, "a", "b")
+	if err := os.MkdirAll(nested, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("STAMPY_CONFIG", userPath)
+
+	cfg, err := LoadConfig(nested)
+	if err != nil {
+		t.Fatalf("LoadConfig returned error: %v", err)
+	}
+	want := FileConfig{
+		Template: "{line} {}",
+		TZ:       "Asia/Tokyo",
+		Locale:   "ja",
+		Color:    "never",
+		Presets: map[string]Preset{
+			"mine":   {Template: "U {}"},
+			"shared": {Template: "project {}"},
+		},
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Fatalf("unexpected config: got %+v want %+v", cfg, want)
+	}
+
+	// Flags and environment variables arrive as options and beat the files.
+	opts := ApplyConfig(Options{TZ: "America/New_York", JSONKey: "ts"}, cfg)
+	if opts.Template != "{line} {}" || !opts.TemplateProvided || opts.TZ != "America/New_York" || opts.JSONKey != "ts" || opts.Locale != "ja" || opts.Color != "never" {
+		t.Fatalf("unexpected options: %+v", opts)
+	}
+	if opts = ApplyConfig(Options{JSONKey: "env", NoJSON: true}, FileConfig{JSON: "ts"}); opts.JSONKey != "" {
+		t.Fatalf("--no-json should keep text mode, got JSON key %q", opts.JSONKey)
+	}
+	opts = ApplyConfig(Options{Template: "{}", TemplateProvided: true}, cfg)
+	if opts.Template != "{}" || opts.Presets["shared"].Template != "project {}" {
+		t.Fatalf("unexpected options: %+v", opts)
+	}
+}
+
+func TestNeedsConfig(t *testing.T) {
+	cases := []struct {
+		opts Options
+		want bool
+	}{
+		{opts: Options{}, want: true},
+		{opts: Options{Template: "@build", TemplateProvided: true}, want: true},
+		{opts: Options{Template: "{iso} {}", TemplateProvided: true}, want: false},
+		{opts: Options{Template: "user@host {}", TemplateProvided: true}, want: false},
+	}
+	for _, tc := range cases {
+		if got := NeedsConfig(tc.opts); got != tc.want {
+			t.Errorf("NeedsConfig(%+v) = %v, want %v", tc.opts, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// delimiter splits input into records and terminates the lines stampy writes.
+type delimiter struct {
+	sep string
+	// crlf treats a carriage return before sep as part of the terminator, so
+	// "a\r\n" yields the text "a" and is written back with "\r\n".
+	crlf bool
+}
+
+var newlineDelimiter = delimiter{sep: "\n"}
+
+// parseDelimiter reads a --delimiter value: lf (the default), crlf, nul, or an
+// arbitrary string with backslash escapes such as "\t" or "\x1e".
+func parseDelimiter(value string) (delimiter, error) {
+	switch strings.ToLower(value) {
+	case "", "lf", `\n`, "\n":
+		return newlineDelimiter, nil
+	case "crlf", `\r\n`, "\r\n":
+		return delimiter{sep: "\n", crlf: true}, nil
+	case "nul", "null", `\0`, "\x00":
+		return delimiter{sep: "\x00"}, nil
+	}
+	var sep strings.Builder
+	for rest := value; rest != ""; {
+		ch, multibyte, tail, err := strconv.UnquoteChar(rest, 0)
+		if err != nil {
+			return delimiter{}, fmt.Errorf("invalid delimiter '%s': bad escape sequence", value)
+		}
+		if multibyte {
+			sep.WriteRune(ch)
+		} else {
+			sep.WriteByte(byte(ch))
+		}
+		rest = tail
+	}
+	return delimiter{sep: sep.String()}, nil
+}
+
+// read returns the next record including its delimiter, or the remaining input
+// without one at EOF.
+func (d delimiter) read(r *bufio.Reader) (string, error) {
+	last := d.sep[len(d.sep)-1]
+	var record strings.Builder
+	for {
+		chunk, err := r.ReadString(last)
+		record.WriteString(chunk)
+		if err != nil || strings.HasSuffix(record.String(), d.sep) {
+			return record.String(), err
+		}
+	}
+}
+
+// split separates a record read by read into its text and terminator; the
+// terminator is empty for a final record without a delimiter.
+func (d delimiter) split(record string) (text, terminator string) {
+	text, ok := strings.CutSuffix(record, d.sep)
+	if !ok {
+		return record, ""
+	}
+	terminator = d.sep
+	if d.crlf {
+		if trimmed, ok := strings.CutSuffix(text, "\r"); ok {
+			text, terminator = trimmed, "\r"+d.sep
+		}
+	}
+	return text, terminator
+}
+
+// eol terminates lines stampy writes itself, such as heartbeats and guard
+// markers.
+func (d delimiter) eol() string {
+	if d.crlf {
+		return "\r" + d.sep
+	}
+	return d.sep
+}
@@ -0,0 +1,126 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yiblet/stampy/internal/template"
+)
+
+func TestParseDelimiter(t *testing.T) {
+	tests := []struct {
+		value string
+		want  delimiter
+	}{
+		{value: "", want: delimiter{sep: "\n"}},
+		{value: "LF", want: delimiter{sep: "\n"}},
+		{value: `\n`, want: delimiter{sep: "\n"}},
+		{value: "crlf", want: delimiter{sep: "\n", crlf: true}},
+		{value: `\r\n`, want: delimiter{sep: "\n", crlf: true}},
+		{value: "nul", want: delimiter{sep: "\x00"}},
+		{value: `\0`, want: delimiter{sep: "\x00"}},
+		{value: `\t`, want: delimiter{sep: "\t"}},
+		{value: `\x1e`, want: delimiter{sep: "\x1e"}},
+		{value: "---", want: delimiter{sep: "---"}},
+		{value: "§", want: delimiter{sep: "§"}},
+	}
+	for _, tt := range tests {
+		got, err := parseDelimiter(tt.value)
+		if err != nil {
+			t.Fatalf("parseDelimiter(%q) returned error: %v", tt.value, err)
+		}
+		if got != tt.want {
+			t.Errorf("parseDelimiter(%q) = %+v, want %+v", tt.value, got, tt.want)
+		}
+	}
+
+	if _, err := parseDelimiter(`\q`); err == nil {
+		t.Fatal("expected error for bad escape")
+	}
+}
+
+func TestDelimiterReadAndSplit(t *testing.T) {
+	tests := []struct {
+		name  string
+		delim delimiter
+		input string
+		texts []string
+		terms []string
+	}{
+		{name: "lf keeps carriage returns", delim: delimiter{sep: "\n"}, input: "a\r\nb",
+			texts: []string{"a\r", "b"}, terms: []string{"\n", ""}},
+		{name: "crlf", delim: delimiter{sep: "\n", crlf: true}, input: "a\r\nb\nc\r\n",
+			texts: []string{"a", "b", "c"}, terms: []string{"\r\n", "\n", "\r\n"}},
+		{name: "nul", delim: delimiter{sep: "\x00"}, input: "one two\x00three\x00",
+			texts: []string{"one two", "three"}, terms: []string{"\x00", "\x00"}},
+		{name: "multi-byte", delim: delimiter{sep: "--"}, input: "a-b--c---d",
+			texts: []string{"a-b", "c", "-d"}, terms: []string{"--", "--", ""}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := bufio.NewReader(strings.NewReader(tt.input))
+			var texts, terms []string
+			for {
+				record, err := tt.delim.read(reader)
+				if record != "" {
+					text, term := tt.delim.split(record)
+					texts = append(texts, text)
+					terms = append(terms, term)
+				}
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				if err != nil {
+					t.Fatalf("read returned error: %v", err)
+				}
+			}
+			if strings.Join(texts, "|") != strings.Join(tt.texts, "|") || strings.Join(terms, "|") != strings.Join(tt.terms, "|") {
+				t.Fatalf("got texts %q terms %q, want %q %q", texts, terms, tt.texts, tt.terms)
+			}
+		})
+	}
+}
+
+func TestProcessLinesDelimiters(t *testing.T) {
+	tests := []struct {
+		name      string
+		delimiter string
+		jsonKey   string
+		template  string
+		input     string
+		want      string
+	}{
+		{name: "crlf", delimiter: "crlf", template: "[{}] {len}", input: "one\r\ntwo\r\n",
+			want: "[one] 3\r\n[two] 3\r\n"},
+		{name: "nul", delimiter: "nul", template: "{line} {}", input: "./a b\x00./c\x00",
+			want: "1 ./a b\x002 ./c\x00"},
+		{name: "custom with offsets", delimiter: "||", template: "{offset}:{}", input: "ab||cd||e",
+			want: "0:ab||4:cd||8:e"},
+		{name: "jsonl crlf", delimiter: "crlf", jsonKey: "n", template: "{line}", input: "{\"a\":1}\r\n",
+			want: "{\"a\":1,\"n\":\"1\"}\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tpl, err := template.Parse(tt.template)
+			if err != nil {
+				t.Fatalf("parse failed: %v", err)
+			}
+			opts := Options{Delimiter: tt.delimiter, JSONKey: tt.jsonKey}
+			var output bytes.Buffer
+			clock := newFakeClock(time.Unix(0, 0))
+			if err := processLines(strings.NewReader(tt.input), &output, tpl, opts, clock, nil); err != nil {
+				t.Fatalf("processLines returned error: %v", err)
+			}
+			if output.String() != tt.want {
+				t.Fatalf("unexpected output: got %q want %q", output.String(), tt.want)
+			}
+		})
+	}
+}
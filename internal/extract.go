@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// fieldExtractor captures a named value from each input line with a regular
+// expression configured through --extract NAME=REGEX.
+type fieldExtractor struct {
+	name  string
+	re    *regexp.Regexp
+	group int
+}
+
+// parseExtractors compiles NAME=REGEX specs. The field takes the capture group
+// named NAME when present, otherwise the first capture group, otherwise the
+// whole match. Other named groups in the pattern become fields of their own.
+func parseExtractors(specs []string) ([]fieldExtractor, error) {
+	extractors := make([]fieldExtractor, 0, len(specs))
+	for _, spec := range specs {
+		name, pattern, ok := strings.Cut(spec, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || pattern == "" {
+			return nil, fmt.Errorf("invalid extract '%s' (want NAME=REGEX)", spec)
+		}
+		if err := checkName("extract", name); err != nil {
+			return nil, err
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid extract pattern for '%s': %w", name, err)
+		}
+		group := 0
+		if idx := re.SubexpIndex(name); idx != -1 {
+			group = idx
+		} else if re.NumSubexp() > 0 {
+			group = 1
+		}
+		extractors = append(extractors, fieldExtractor{name: name, re: re, group: group})
+	}
+	return extractors, nil
+}
+
+// namePattern restricts --extract and --timer names to identifiers, so they
+// cannot contain the ':', '|' or '}' that end a {field:NAME} or {timer:NAME}
+// token.
+var namePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func checkName(kind, name string) error {
+	if !namePattern.MatchString(name) {
+		return fmt.Errorf("invalid %s name '%s' (use letters, digits and underscores, not starting with a digit)", kind, name)
+	}
+	return nil
+}
+
+// extractFields applies every extractor to text. Fields whose pattern does not
+// match are absent from the result.
+func extractFields(extractors []fieldExtractor, text string) map[string]string {
+	if len(extractors) == 0 {
+		return nil
+	}
+	fields := map[string]string{}
+	for _, ex := range extractors {
+		match := ex.re.FindStringSubmatch(text)
+		if match == nil {
+			continue
+		}
+		fields[ex.name] = match[ex.group]
+		for i, group := range ex.re.SubexpNames() {
+			if group != "" && group != ex.name {
+				fields[group] = match[i]
+			}
+		}
+	}
+	return fields
+}
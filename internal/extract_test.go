@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yiblet/stampy/internal/template"
+)
+
+func TestExtractFields(t *testing.T) {
+	extractors, err := parseExtractors([]string{
+		`level=\b(INFO|WARN|ERROR)\b`,
+		`req=request_id=(?P<req>\w+) user=(?P<user>\w+)`,
+		`code=\d{3}`,
+	})
+	if err != nil {
+		t.Fatalf("parseExtractors returned error: %v", err)
+	}
+
+	cases := []struct {
+		text string
+		want map[string]string
+	}{
+		{
+			text: "ERROR request_id=ab12 user=alice status 503",
+			want: map[string]string{"level": "ERROR", "req": "ab12", "user": "alice", "code": "503"},
+		},
+		{
+			text: "INFO ready",
+			want: map[string]string{"level": "INFO"},
+		},
+		{
+			text: "nothing here",
+			want: map[string]string{},
+		},
+	}
+	for _, tc := range cases {
+		if got := extractFields(extractors, tc.text); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("extractFields(%q) = %v, want %v", tc.text, got, tc.want)
+		}
+	}
+
+	if got := extractFields(nil, "anything"); got != nil {
+		t.Fatalf("expected nil fields without extractors, got %v", got)
+	}
+}
+
+func TestParseExtractorsErrors(t *testing.T) {
+	for _, spec := range []string{"noequals", "=pattern", "name=", "bad=(", "a:b=x", "a}=x", "a|b=x", "1st=x", "a-b=x"} {
+		if _, err := parseExtractors([]string{spec}); err == nil {
+			t.Errorf("expected error for extract %q", spec)
+		}
+	}
+}
+
+func TestProcessLinesExtractedFields(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tpl, err := template.Parse(`{field:level:<5|"-"} {}`)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+
+	input := "WARN disk low\nplain line\n"
+	opts := Options{Extract: []string{`level=^(INFO|WARN|ERROR)`}}
+
+	var output bytes.Buffer
+	if err := processLines(strings.NewReader(input), &output, tpl, opts, newFakeClock(base), nil); err != nil {
+		t.Fatalf("processLines returned error: %v", err)
+	}
+	want := "WARN  WARN disk low\n-     plain line\n"
+	if output.String() != want {
+		t.Fatalf("unexpected output: got %q want %q", output.String(), want)
+	}
+
+	output.Reset()
+	opts.JSONKey = "ts"
+	jsonTpl, err := template.Parse("{line}")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	input = "{\"msg\":\"WARN x\",\"level\":\"keep\"}\nERROR boom\n"
+	opts.Extract = []string{`level=(INFO|WARN|ERROR)`}
+	if err := processLines(strings.NewReader(input), &output, jsonTpl, opts, newFakeClock(base), nil); err != nil {
+		t.Fatalf("processLines returned error: %v", err)
+	}
+	lines := splitOutput(output.String())
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %d", len(lines))
+	}
+	if lines[0] != `{"level":"keep","msg":"WARN x","ts":"1"}` {
+		t.Errorf("existing keys must not be overwritten: %s", lines[0])
+	}
+	if lines[1] != `{"level":"ERROR","line":"ERROR boom","ts":"2"}` {
+		t.Errorf("unexpected wrapped line: %s", lines[1])
+	}
+}
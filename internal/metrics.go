@@ -0,0 +1,176 @@
+package internal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateWindow is the number of one-second buckets used to compute the current line rate.
+const rateWindow = 10
+
+// deltaBounds are the upper bounds, in seconds, of the delta histogram buckets.
+var deltaBounds = []float64{0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300}
+
+type rateBucket struct {
+	second int64
+	count  uint64
+}
+
+// lineMetrics tracks stream statistics and renders them in the Prometheus text format.
+// A nil *lineMetrics is valid and ignores every observation.
+type lineMetrics struct {
+	mu           sync.Mutex
+	nowFn        func() time.Time
+	started      time.Time
+	lines        uint64
+	bytes        uint64
+	jsonFailures uint64
+	lastLine     time.Time
+	haveLast     bool
+	rate         [rateWindow]rateBucket
+	deltaCounts  []uint64
+	deltaCount   uint64
+	deltaSum     float64
+}
+
+func newLineMetrics(nowFn func() time.Time) *lineMetrics {
+	return &lineMetrics{
+		nowFn:       nowFn,
+		started:     nowFn(),
+		deltaCounts: make([]uint64, len(deltaBounds)),
+	}
+}
+
+// observeLine records a line of n raw bytes read at ts. The gap since the previous
+// line is the {delta} of that previous line, so it feeds the delta histogram.
+func (m *lineMetrics) observeLine(n int, ts time.Time) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lines++
+	m.bytes += uint64(n)
+
+	if m.haveLast {
+		m.observeDelta(ts.Sub(m.lastLine).Seconds())
+	}
+	m.lastLine = ts
+	m.haveLast = true
+
+	sec := ts.Unix()
+	bucket := &m.rate[sec%rateWindow]
+	if bucket.second != sec {
+		bucket.second = sec
+		bucket.count = 0
+	}
+	bucket.count++
+}
+
+func (m *lineMetrics) observeDelta(seconds float64) {
+	for i, bound := range deltaBounds {
+		if seconds <= bound {
+			m.deltaCounts[i]++
+			break
+		}
+	}
+	m.deltaCount++
+	m.deltaSum += seconds
+}
+
+// observeJSONFailure records a JSONL input line that could not be decoded.
+func (m *lineMetrics) observeJSONFailure() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.jsonFailures++
+}
+
+// linesPerSecond averages the line count over the completed seconds of the rate window.
+func (m *lineMetrics) linesPerSecond(now time.Time) float64 {
+	current := now.Unix()
+	var total uint64
+	for _, bucket := range m.rate {
+		if bucket.second < current && bucket.second >= current-rateWindow {
+			total += bucket.count
+		}
+	}
+	return float64(total) / rateWindow
+}
+
+// writeTo renders all metrics in the Prometheus text exposition format.
+func (m *lineMetrics) writeTo(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.nowFn()
+	last := m.started
+	if m.haveLast {
+		last = m.lastLine
+	}
+
+	bw := bufio.NewWriter(w)
+	writeMetric(bw, "stampy_lines_total", "counter", "Lines read from the input.", strconv.FormatUint(m.lines, 10))
+	writeMetric(bw, "stampy_bytes_total", "counter", "Bytes read from the input, including line terminators.", strconv.FormatUint(m.bytes, 10))
+	writeMetric(bw, "stampy_lines_per_second", "gauge", fmt.Sprintf("Lines per second averaged over the last %d seconds.", rateWindow), formatFloat(m.linesPerSecond(now)))
+	writeMetric(bw, "stampy_seconds_since_last_line", "gauge", "Seconds since the most recent input line (or since startup when none has arrived).", formatFloat(now.Sub(last).Seconds()))
+	writeMetric(bw, "stampy_json_parse_failures_total", "counter", "JSONL input lines that were not valid JSON.", strconv.FormatUint(m.jsonFailures, 10))
+
+	fmt.Fprintln(bw, "# HELP stampy_delta_seconds Seconds between consecutive input lines ({delta}).")
+	fmt.Fprintln(bw, "# TYPE stampy_delta_seconds histogram")
+	var cumulative uint64
+	for i, bound := range deltaBounds {
+		cumulative += m.deltaCounts[i]
+		fmt.Fprintf(bw, "stampy_delta_seconds_bucket{le=\"%s\"} %d\n", formatFloat(bound), cumulative)
+	}
+	fmt.Fprintf(bw, "stampy_delta_seconds_bucket{le=\"+Inf\"} %d\n", m.deltaCount)
+	fmt.Fprintf(bw, "stampy_delta_seconds_sum %s\n", formatFloat(m.deltaSum))
+	fmt.Fprintf(bw, "stampy_delta_seconds_count %d\n", m.deltaCount)
+
+	return bw.Flush()
+}
+
+func writeMetric(w io.Writer, name, kind, help, value string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", name, help, name, kind, name, value)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// ServeHTTP exposes the metrics on any path using the Prometheus text format.
+func (m *lineMetrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = m.writeTo(w)
+}
+
+// serveMetrics starts an HTTP server exposing m on addr and returns a function
+// that shuts the server down.
+func serveMetrics(addr string, m *lineMetrics) (func() error, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("metrics listen: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		_ = srv.Serve(ln)
+	}()
+	return func() error {
+		if err := srv.Close(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	}, nil
+}
@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yiblet/stampy/internal/template"
+)
+
+func TestLineMetricsWriteTo(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := newFakeClock(base, base.Add(3*time.Second))
+	stats := newLineMetrics(clock)
+
+	stats.observeLine(6, base)
+	stats.observeLine(4, base.Add(200*time.Millisecond))
+	stats.observeLine(11, base.Add(2200*time.Millisecond))
+	stats.observeJSONFailure()
+
+	var buf bytes.Buffer
+	if err := stats.writeTo(&buf); err != nil {
+		t.Fatalf("writeTo returned error: %v", err)
+	}
+	out := buf.String()
+
+	for _, want := range []string{
+		"stampy_lines_total 3\n",
+		"stampy_bytes_total 21\n",
+		"stampy_lines_per_second 0.3\n",
+		"stampy_seconds_since_last_line 0.8\n",
+		"stampy_json_parse_failures_total 1\n",
+		"stampy_delta_seconds_bucket{le=\"0.1\"} 0\n",
+		"stampy_delta_seconds_bucket{le=\"0.5\"} 1\n",
+		"stampy_delta_seconds_bucket{le=\"5\"} 2\n",
+		"stampy_delta_seconds_bucket{le=\"+Inf\"} 2\n",
+		"stampy_delta_seconds_sum 2.2\n",
+		"stampy_delta_seconds_count 2\n",
+		"# TYPE stampy_delta_seconds histogram\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("metrics output missing %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestLineMetricsNilIsNoop(t *testing.T) {
+	var stats *lineMetrics
+	stats.observeLine(10, time.Now())
+	stats.observeJSONFailure()
+}
+
+func TestProcessLinesRecordsMetrics(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := newFakeClock(base, base.Add(time.Second), base.Add(2*time.Second))
+	stats := newLineMetrics(clock)
+
+	tpl, err := template.Parse("{elapsed:.0f}s")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+
+	input := strings.NewReader("{\"ok\":true}\nnot json\n")
+	var output bytes.Buffer
+	if err := processLines(input, &output, tpl, Options{JSONKey: "ts"}, clock, stats); err != nil {
+		t.Fatalf("processLines returned error: %v", err)
+	}
+
+	if stats.lines != 2 || stats.bytes != 21 {
+		t.Fatalf("unexpected counters: lines=%d bytes=%d", stats.lines, stats.bytes)
+	}
+	if stats.jsonFailures != 1 {
+		t.Fatalf("unexpected json failures: %d", stats.jsonFailures)
+	}
+	if stats.deltaCount != 1 || stats.deltaSum != 1 {
+		t.Fatalf("unexpected delta histogram: count=%d sum=%v", stats.deltaCount, stats.deltaSum)
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	stats := newLineMetrics(time.Now)
+	stats.observeLine(3, time.Now())
+
+	shutdown, err := serveMetrics("127.0.0.1:0", stats)
+	if err != nil {
+		t.Fatalf("serveMetrics returned error: %v", err)
+	}
+	if err := shutdown(); err != nil {
+		t.Fatalf("shutdown returned error: %v", err)
+	}
+
+	if _, err := serveMetrics("not-an-address", stats); err == nil {
+		t.Fatalf("expected listen error for invalid address")
+	}
+}
+
+func TestLineMetricsServeHTTP(t *testing.T) {
+	stats := newLineMetrics(time.Now)
+	stats.observeLine(3, time.Now())
+
+	rec := httptest.NewRecorder()
+	stats.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if got := rec.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/plain") {
+		t.Fatalf("unexpected content type: %q", got)
+	}
+	if !strings.Contains(rec.Body.String(), "stampy_lines_total 1\n") {
+		t.Fatalf("unexpected body: %q", rec.Body.String())
+	}
+}
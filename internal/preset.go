@@ -0,0 +1,225 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/yiblet/stampy/internal/template"
+)
+
+// Preset is a named template selected with @name in place of a template.
+type Preset struct {
+	Template string
+	// JSONKey enables JSONL mode with this key unless --json or --no-json is
+	// given.
+	JSONKey     string
+	Description string
+}
+
+// builtinPresets ship with stampy; user presets with the same name replace them.
+var builtinPresets = map[string]Preset{
+	"iso": {
+		Template:    defaultTemplate,
+		Description: "ISO 8601 timestamp (the default)",
+	},
+	"ts": {
+		Template:    "{time:%b %d %H:%M:%S} {}",
+		Description: "moreutils ts style wall-clock time",
+	},
+	"utc": {
+		Template:    "{iso@UTC}: {}",
+		Description: "ISO 8601 timestamp in UTC",
+	},
+	"elapsed": {
+		Template:    "{elapsed:>8.3f}s {}",
+		Description: "seconds since the first line",
+	},
+	"incremental": {
+		Template:    "+{since:>7.3f}s {}",
+		Description: "seconds since the previous line, like ts -i",
+	},
+	"build": {
+		Template:    "[{elapsed:>12clock}] {if delta > 5s}{color:red}SLOW{reset} {end}{}",
+		Description: "build logs: elapsed clock, slow steps flagged",
+	},
+	"syslog": {
+		Template:    "{time:%b %e %H:%M:%S} {host} {}",
+		Description: "syslog (RFC 3164) style prefix",
+	},
+	"jsonl-ts": {
+		Template:    "{iso}",
+		JSONKey:     "ts",
+		Description: "JSONL output with an ISO timestamp in \"ts\"",
+	},
+}
+
+var presetRefPattern = regexp.MustCompile(`^@[A-Za-z0-9_.-]+$`)
+
+// presetRef returns the preset name when tpl is an @name reference.
+func presetRef(tpl string) (string, bool) {
+	if !presetRefPattern.MatchString(tpl) {
+		return "", false
+	}
+	return tpl[1:], true
+}
+
+// lookupPreset finds a preset by name, preferring user presets over built-ins.
+func lookupPreset(name string, user map[string]Preset) (Preset, error) {
+	if preset, ok := user[name]; ok {
+		return preset, nil
+	}
+	if preset, ok := builtinPresets[name]; ok {
+		return preset, nil
+	}
+	return Preset{}, fmt.Errorf("unknown preset '@%s' (available: %s)", name, strings.Join(presetNames(user), ", "))
+}
+
+func presetNames(user map[string]Preset) []string {
+	seen := map[string]bool{}
+	var names []string
+	for _, presets := range []map[string]Preset{builtinPresets, user} {
+		for name := range presets {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// applyPreset replaces an @name template with the preset's template and, when
+// the preset asks for JSONL output and neither --json nor --no-json was given,
+// its key.
+func applyPreset(opts Options) (Options, error) {
+	name, ok := presetRef(opts.Template)
+	if !ok {
+		return opts, nil
+	}
+	preset, err := lookupPreset(name, opts.Presets)
+	if err != nil {
+		return opts, err
+	}
+	opts.Template = preset.Template
+	if opts.JSONKey == "" && !opts.NoJSON {
+		opts.JSONKey = preset.JSONKey
+	}
+	return opts, nil
+}
+
+// ListPresets writes a table of the built-in and user presets.
+func ListPresets(w io.Writer, user map[string]Preset) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tTEMPLATE\tDESCRIPTION")
+	for _, name := range presetNames(user) {
+		preset, _ := lookupPreset(name, user)
+		description := preset.Description
+		if _, ok := user[name]; ok {
+			description = strings.TrimSpace(description + " (user)")
+		}
+		if preset.JSONKey != "" {
+			description = strings.TrimSpace(fmt.Sprintf("%s [--json %s]", description, preset.JSONKey))
+		}
+		fmt.Fprintf(tw, "@%s\t%s\t%s\n", name, preset.Template, description)
+	}
+	return tw.Flush()
+}
+
+// ShowPreset writes the template of one preset, plus its JSON key if any.
+func ShowPreset(w io.Writer, name string, user map[string]Preset) error {
+	preset, err := lookupPreset(strings.TrimPrefix(name, "@"), user)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(w, preset.Template); err != nil {
+		return err
+	}
+	if preset.JSONKey != "" {
+		_, err = fmt.Fprintf(w, "# JSONL mode: --json %s\n", preset.JSONKey)
+	}
+	return err
+}
+
+// previewLines are the sample lines rendered by PreviewTemplate, with the
+// offset from the first line at which each one arrives.
+var previewLines = []struct {
+	text  string
+	after time.Duration
+}{
+	{"Starting build", 0},
+	{"Step 1/3 : FROM golang:1.24", 1200 * time.Millisecond},
+	{`{"level":"info","msg":"compiled","files":42}`, 1500 * time.Millisecond},
+	{"Step 2/3 : RUN go test ./...", 8500 * time.Millisecond},
+	{"Build finished", 9 * time.Second},
+}
+
+// previewStart is the fixed time of the first preview line, and previewRunID
+// the {run_id} shown in previews.
+var previewStart = time.Date(2024, 9, 27, 21, 30, 45, 0, time.UTC)
+
+const previewRunID = "01J8VX0S2R0000000000000000"
+
+// PreviewTemplate renders sample lines through a preset (@name or bare name)
+// or a literal template using a fixed clock, so output is reproducible. Times
+// are shown in UTC unless opts.TZ says otherwise; colour is never used.
+func PreviewTemplate(w io.Writer, tpl string, opts Options) error {
+	if _, err := lookupPreset(tpl, opts.Presets); err == nil {
+		tpl = "@" + tpl
+	}
+	opts.Template = tpl
+	opts.TemplateProvided = true
+	opts, err := applyPreset(opts)
+	if err != nil {
+		return err
+	}
+	opts.Color = "never"
+	if opts.TZ == "" {
+		opts.TZ = "UTC"
+	}
+	if opts.RunID == "" {
+		opts.RunID = previewRunID
+	}
+
+	// Keep {seq} away from the real counter file.
+	dir, err := os.MkdirTemp("", "stampy-preview")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	opts.SeqFile = filepath.Join(dir, "seq")
+
+	cfg, err := templateConfig(opts, nil)
+	if err != nil {
+		return err
+	}
+	parsed, err := template.ParseWithConfig(opts.Template, cfg)
+	if err != nil {
+		return fmt.Errorf("parse template: %w", err)
+	}
+
+	var input strings.Builder
+	times := make([]time.Time, 0, len(previewLines))
+	for _, line := range previewLines {
+		input.WriteString(line.text + "\n")
+		times = append(times, previewStart.Add(line.after))
+	}
+	return processLines(strings.NewReader(input.String()), w, parsed, opts, previewClock(times), nil)
+}
+
+// previewClock returns each of times in turn, then keeps returning the last.
+func previewClock(times []time.Time) func() time.Time {
+	i := 0
+	return func() time.Time {
+		t := times[min(i, len(times)-1)]
+		i++
+		return t
+	}
+}
@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestApplyPreset(t *testing.T) {
+	user := map[string]Preset{
+		"deploy": {Template: "{iso} deploy {}"},
+		"ts":     {Template: "{time:%T} {}"},
+	}
+
+	tests := []struct {
+		name     string
+		opts     Options
+		template string
+		jsonKey  string
+	}{
+		{name: "literal template untouched", opts: Options{Template: "{line} {}"}, template: "{line} {}"},
+		{name: "builtin", opts: Options{Template: "@elapsed"}, template: "{elapsed:>8.3f}s {}"},
+		{name: "user preset", opts: Options{Template: "@deploy"}, template: "{iso} deploy {}"},
+		{name: "user overrides builtin", opts: Options{Template: "@ts"}, template: "{time:%T} {}"},
+		{name: "preset json key", opts: Options{Template: "@jsonl-ts"}, template: "{iso}", jsonKey: "ts"},
+		{name: "json flag wins", opts: Options{Template: "@jsonl-ts", JSONKey: "time"}, template: "{iso}", jsonKey: "time"},
+		{name: "no-json wins", opts: Options{Template: "@jsonl-ts", NoJSON: true}, template: "{iso}"},
+		{name: "not a reference", opts: Options{Template: "@ {}"}, template: "@ {}"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.Presets = user
+			got, err := applyPreset(tt.opts)
+			if err != nil {
+				t.Fatalf("applyPreset returned error: %v", err)
+			}
+			if got.Template != tt.template || got.JSONKey != tt.jsonKey {
+				t.Fatalf("got template %q json %q, want %q json %q", got.Template, got.JSONKey, tt.template, tt.jsonKey)
+			}
+		})
+	}
+}
+
+func TestApplyPresetUnknown(t *testing.T) {
+	_, err := applyPreset(Options{Template: "@nope"})
+	if err == nil || !strings.Contains(err.Error(), "unknown preset '@nope'") || !strings.Contains(err.Error(), "elapsed") {
+		t.Fatalf("expected unknown preset error listing presets, got %v", err)
+	}
+}
+
+func TestBuiltinPresetsParse(t *testing.T) {
+	for name := range builtinPresets {
+		var out bytes.Buffer
+		if err := PreviewTemplate(&out, name, Options{}); err != nil {
+			t.Errorf("preset %s: %v", name, err)
+		}
+	}
+}
+
+func TestListAndShowPresets(t *testing.T) {
+	user := map[string]Preset{"deploy": {Template: "{iso} {}", Description: "deploys"}}
+
+	var list bytes.Buffer
+	if err := ListPresets(&list, user); err != nil {
+		t.Fatalf("ListPresets returned error: %v", err)
+	}
+	for _, want := range []string{"@deploy", "deploys (user)", "@jsonl-ts", "[--json ts]"} {
+		if !strings.Contains(list.String(), want) {
+			t.Errorf("list output missing %q:\n%s", want, list.String())
+		}
+	}
+
+	var show bytes.Buffer
+	if err := ShowPreset(&show, "@jsonl-ts", user); err != nil {
+		t.Fatalf("ShowPreset returned error: %v", err)
+	}
+	if want := "{iso}\n# JSONL mode: --json ts\n"; show.String() != want {
+		t.Fatalf("unexpected show output: got %q want %q", show.String(), want)
+	}
+}
+
+func TestPreviewTemplateUsesConfiguredZoneAndLocale(t *testing.T) {
+	opts := ApplyConfig(Options{}, FileConfig{TZ: "Asia/Tokyo", Locale: "de"})
+	var out bytes.Buffer
+	if err := PreviewTemplate(&out, "{time:%a %T}", opts); err != nil {
+		t.Fatalf("PreviewTemplate returned error: %v", err)
+	}
+	if first, _, _ := strings.Cut(out.String(), "\n"); first != "Sa 06:30:45 Starting build" {
+		t.Fatalf("unexpected first preview line: %q", first)
+	}
+}
+
+func TestPreviewTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{
+			template: "incremental",
+			want: "+  0.000s Starting build\n" +
+				"+  1.200s Step 1/3 : FROM golang:1.24\n" +
+				"+  0.300s {\"level\":\"info\",\"msg\":\"compiled\",\"files\":42}\n" +
+				"+  7.000s Step 2/3 : RUN go test ./...\n" +
+				"+  0.500s Build finished\n",
+		},
+		{
+			template: "{time:%T} {line} {run_id} {}",
+			want: "21:30:45 1 " + previewRunID + " Starting build\n" +
+				"21:30:46 2 " + previewRunID + " Step 1/3 : FROM golang:1.24\n" +
+				"21:30:46 3 " + previewRunID + " {\"level\":\"info\",\"msg\":\"compiled\",\"files\":42}\n" +
+				"21:30:53 4 " + previewRunID + " Step 2/3 : RUN go test ./...\n" +
+				"21:30:54 5 " + previewRunID + " Build finished\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := PreviewTemplate(&out, tt.template, Options{}); err != nil {
+				t.Fatalf("PreviewTemplate returned error: %v", err)
+			}
+			if out.String() != tt.want {
+				t.Fatalf("unexpected preview:\n got %q\nwant %q", out.String(), tt.want)
+			}
+		})
+	}
+}
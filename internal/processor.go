@@ -2,7 +2,9 @@ package internal
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
+	"strings"
 	"time"
 
 	"github.com/yiblet/stampy/internal/template"
@@ -11,8 +13,31 @@ import (
 type emission struct {
 	record  lineRecord
 	delta   time.Duration
+	since   time.Duration
 	elapsed time.Duration
 	line    int
+	timers  map[string]time.Duration
+	// seq is the {seq} number, claimed from the seq store when the line is
+	// emitted.
+	seq int64
+}
+
+// state builds the template state for the emission. JSONL mode renders without
+// the line text so it is not auto-appended to the stamp.
+func (em emission) state(lineText string) template.StampState {
+	return template.StampState{
+		Now:      em.record.timestamp,
+		Delta:    em.delta,
+		Since:    em.since,
+		Elapsed:  em.elapsed,
+		Line:     em.line,
+		LineText: lineText,
+		Raw:      em.record.text,
+		Offset:   em.record.offset,
+		Fields:   em.record.fields,
+		Seq:      em.seq,
+		Timers:   em.timers,
+	}
 }
 
 type lineBuffer struct {
@@ -21,6 +46,15 @@ type lineBuffer struct {
 	pending    lineRecord
 	hasPending bool
 	lineNumber int
+	// immediate emits each line as soon as it is pushed. It is used when the
+	// template never renders {delta}, which needs the following line's time.
+	immediate bool
+	previous  time.Time
+	// timerNames are the --timer stopwatches; anchors holds the time each was
+	// last restarted. Timers not yet restarted count from the first line.
+	timerNames []string
+	anchors    map[string]time.Time
+	origin     time.Time
 }
 
 func newLineBuffer() *lineBuffer {
@@ -30,17 +64,32 @@ func newLineBuffer() *lineBuffer {
 func (b *lineBuffer) push(record lineRecord) *emission {
 	if !b.haveStart {
 		b.start = record.timestamp
+		b.origin = record.timestamp
 		b.haveStart = true
 	}
 
-	if !b.hasPending {
-		b.pending = record
-		b.hasPending = true
-		return nil
+	// The pending line is measured from the old anchor before an anchoring
+	// line moves it.
+	var emit *emission
+	if b.hasPending {
+		emit = b.prepareEmission(b.pending, record.timestamp.Sub(b.pending.timestamp))
+		b.hasPending = false
+	}
+	if record.anchor {
+		b.start = record.timestamp
+	}
+	for _, name := range record.resets {
+		if b.anchors == nil {
+			b.anchors = map[string]time.Time{}
+		}
+		b.anchors[name] = record.timestamp
 	}
 
-	emit := b.prepareEmission(b.pending, record.timestamp.Sub(b.pending.timestamp))
+	if b.immediate {
+		return b.prepareEmission(record, 0)
+	}
 	b.pending = record
+	b.hasPending = true
 	return emit
 }
 
@@ -53,12 +102,41 @@ func (b *lineBuffer) flush() *emission {
 	return emit
 }
 
+// release emits the pending line early, measuring its delta up to now. It is used
+// when a synthetic line (such as a heartbeat) must not be printed ahead of it.
+func (b *lineBuffer) release(now time.Time) *emission {
+	if !b.hasPending {
+		return nil
+	}
+	emit := b.prepareEmission(b.pending, now.Sub(b.pending.timestamp))
+	b.hasPending = false
+	return emit
+}
+
 func (b *lineBuffer) prepareEmission(record lineRecord, delta time.Duration) *emission {
+	var since time.Duration
+	if b.lineNumber > 0 {
+		since = record.timestamp.Sub(b.previous)
+	}
+	b.previous = record.timestamp
 	b.lineNumber++
 	elapsed := record.timestamp.Sub(b.start)
+	var timers map[string]time.Duration
+	if len(b.timerNames) > 0 {
+		timers = make(map[string]time.Duration, len(b.timerNames))
+		for _, name := range b.timerNames {
+			anchor, ok := b.anchors[name]
+			if !ok {
+				anchor = b.origin
+			}
+			timers[name] = record.timestamp.Sub(anchor)
+		}
+	}
 	return &emission{
 		record:  record,
 		delta:   delta,
+		since:   since,
+		timers:  timers,
 		elapsed: elapsed,
 		line:    b.lineNumber,
 	}
@@ -67,61 +145,93 @@ func (b *lineBuffer) prepareEmission(record lineRecord, delta time.Duration) *em
 type textEmitter struct {
 	tpl    template.Template
 	writer io.Writer
+	// eol ends heartbeat lines.
+	eol string
 }
 
 func newTextEmitter(tpl template.Template, writer io.Writer) textEmitter {
-	return textEmitter{tpl: tpl, writer: writer}
+	return textEmitter{tpl: tpl, writer: writer, eol: "\n"}
 }
 
 func (e textEmitter) emit(em emission) error {
-	rendered := e.tpl.Render(template.StampState{
-		Now:      em.record.timestamp,
-		Delta:    em.delta,
-		Elapsed:  em.elapsed,
-		Line:     em.line,
-		LineText: em.record.text,
-	})
+	state := em.state(em.record.text)
+	if e.tpl.NeedsJSON() {
+		state.JSON, state.JSONLine = decodeJSONLine(em.record.text)
+	}
+	rendered := e.tpl.Render(state)
 	if _, err := io.WriteString(e.writer, rendered); err != nil {
 		return err
 	}
-	if em.record.hasNewline {
-		if _, err := io.WriteString(e.writer, "\n"); err != nil {
-			return err
-		}
+	if _, err := io.WriteString(e.writer, em.record.ending()); err != nil {
+		return err
 	}
 	return nil
 }
 
+// heartbeatPrefix starts every text-mode heartbeat line so it can be filtered
+// out, e.g. with grep -v '^stampy: heartbeat '.
+const heartbeatPrefix = "stampy: heartbeat "
+
+// emitHeartbeat writes a synthetic idle line rendered from the heartbeat
+// template, marked with heartbeatPrefix.
+func (e textEmitter) emitHeartbeat(tpl template.Template, state template.StampState) error {
+	_, err := io.WriteString(e.writer, heartbeatPrefix+tpl.Render(state)+e.eol)
+	return err
+}
+
+// guardPrefix starts the text-mode marker written when a guard stops the run.
+const guardPrefix = "stampy: "
+
+// emitGuard writes the guard marker as a plain line, outside the template.
+func (e textEmitter) emitGuard(_ template.StampState, guard *GuardError) error {
+	_, err := io.WriteString(e.writer, guardPrefix+guard.Error()+e.eol)
+	return err
+}
+
 // jsonEmitter outputs JSONL format by stamping and merging/wrapping JSON objects.
 type jsonEmitter struct {
 	tpl     template.Template
 	writer  io.Writer
 	jsonKey string
+	stats   *lineMetrics
+	// eol ends heartbeat objects.
+	eol string
 }
 
 // newJSONEmitter creates a new JSONL emitter with the given template, writer, and JSON key.
 func newJSONEmitter(tpl template.Template, writer io.Writer, jsonKey string) jsonEmitter {
-	return jsonEmitter{tpl: tpl, writer: writer, jsonKey: jsonKey}
+	return jsonEmitter{tpl: tpl, writer: writer, jsonKey: jsonKey, eol: "\n"}
 }
 
 // emit processes the emission by rendering the template stamp and merging/wrapping with JSON.
 func (e jsonEmitter) emit(em emission) error {
+	// Decode once so {json:...} tokens in the stamp see the same value we merge into
+	parsed, valid := decodeJSONLine(em.record.text)
+	if !valid {
+		e.stats.observeJSONFailure()
+	}
+
 	// Render the template to get the stamp string
 	// In JSONL mode, we don't want the line text auto-appended to the template
-	stamp := e.tpl.Render(template.StampState{
-		Now:      em.record.timestamp,
-		Delta:    em.delta,
-		Elapsed:  em.elapsed,
-		Line:     em.line,
-		LineText: "", // Empty to prevent auto-appending line text
-	})
+	state := em.state("")
+	state.JSON, state.JSONLine = parsed, valid
+	stamp := e.tpl.Render(state)
 
 	// Process the input line as JSON
-	result, err := e.processJSONLine(em.record.text, stamp)
+	result, err := e.processJSONLine(em.record.text, parsed, valid, stamp)
 	if err != nil {
 		return err
 	}
 
+	// Merge extracted fields without overwriting keys already in the input
+	if obj, ok := result.(map[string]any); ok {
+		for name, value := range em.record.fields {
+			if _, exists := obj[name]; !exists {
+				obj[name] = value
+			}
+		}
+	}
+
 	// Write the result as compact JSON
 	jsonBytes, err := json.Marshal(result)
 	if err != nil {
@@ -132,21 +242,61 @@ func (e jsonEmitter) emit(em emission) error {
 		return err
 	}
 
-	// Only add newline if the original record had one
-	if em.record.hasNewline {
-		if _, err := e.writer.Write([]byte("\n")); err != nil {
-			return err
-		}
+	// Only terminate the object if the original record was terminated
+	if _, err := io.WriteString(e.writer, em.record.ending()); err != nil {
+		return err
 	}
 
 	return nil
 }
 
-// processJSONLine handles the JSON parsing and merging/wrapping logic.
-func (e jsonEmitter) processJSONLine(line, stamp string) (any, error) {
-	// Try to parse the line as JSON
+// emitHeartbeat writes a synthetic idle object flagged with "heartbeat": true.
+func (e jsonEmitter) emitHeartbeat(tpl template.Template, state template.StampState) error {
+	jsonBytes, err := json.Marshal(map[string]any{
+		e.jsonKey:   tpl.Render(state),
+		"heartbeat": true,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = e.writer.Write(append(jsonBytes, e.eol...))
+	return err
+}
+
+// emitGuard writes the guard marker as an object carrying the stamp, the reason
+// under "guard" and the exit code.
+func (e jsonEmitter) emitGuard(state template.StampState, guard *GuardError) error {
+	jsonBytes, err := json.Marshal(map[string]any{
+		e.jsonKey:   e.tpl.Render(state),
+		"guard":     guard.Error(),
+		"exit_code": guard.Code,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = e.writer.Write(append(jsonBytes, e.eol...))
+	return err
+}
+
+// decodeJSONLine parses a line as JSON, reporting whether it was valid.
+// Numbers decode as json.Number so large integer IDs survive unchanged.
+func decodeJSONLine(line string) (any, bool) {
+	dec := json.NewDecoder(strings.NewReader(line))
+	dec.UseNumber()
 	var parsed any
-	if err := json.Unmarshal([]byte(line), &parsed); err != nil {
+	if err := dec.Decode(&parsed); err != nil {
+		return nil, false
+	}
+	// Like json.Unmarshal, reject anything after the first value.
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		return nil, false
+	}
+	return parsed, true
+}
+
+// processJSONLine handles the merging/wrapping logic for a decoded line.
+func (e jsonEmitter) processJSONLine(line string, parsed any, valid bool, stamp string) (any, error) {
+	if !valid {
 		// Parse failed: wrap as {"jsonKey": stamp, "line": originalString}
 		return map[string]any{
 			e.jsonKey: stamp,
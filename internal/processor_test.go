@@ -2,6 +2,7 @@ package internal
 
 import (
 	"bytes"
+	"strings"
 	"testing"
 	"time"
 
@@ -83,3 +84,198 @@ func TestTextEmitterEmit(t *testing.T) {
 		t.Fatalf("unexpected output without newline: %q", buf.String())
 	}
 }
+
+func TestLineBufferRelease(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	buffer := newLineBuffer()
+	if buffer.release(start) != nil {
+		t.Fatalf("expected no emission without a pending record")
+	}
+
+	buffer.push(lineRecord{timestamp: start})
+	emit := buffer.release(start.Add(3 * time.Second))
+	if emit == nil {
+		t.Fatalf("expected release to emit the pending record")
+	}
+	if emit.delta != 3*time.Second || emit.line != 1 {
+		t.Fatalf("unexpected release emission: delta=%v line=%d", emit.delta, emit.line)
+	}
+	if buffer.flush() != nil {
+		t.Fatalf("expected nothing pending after release")
+	}
+}
+
+func TestTextEmitterHeartbeatCanBeFiltered(t *testing.T) {
+	tpl, err := template.Parse("{line} {}")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	heartbeatTpl, err := template.Parse("{iso}: ... no output for {idle:.0f}s")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	emitter := newTextEmitter(tpl, &buf)
+	rec := lineRecord{text: "stampy: heartbeat lookalike", hasNewline: true, timestamp: time.Unix(0, 0)}
+	if err := emitter.emit(emission{record: rec, line: 1}); err != nil {
+		t.Fatalf("emit returned error: %v", err)
+	}
+	state := template.StampState{Now: time.Unix(0, 0).UTC(), Idle: 30 * time.Second}
+	if err := emitter.emitHeartbeat(heartbeatTpl, state); err != nil {
+		t.Fatalf("emitHeartbeat returned error: %v", err)
+	}
+
+	var kept, dropped []string
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		if strings.HasPrefix(line, heartbeatPrefix) {
+			dropped = append(dropped, line)
+		} else {
+			kept = append(kept, line)
+		}
+	}
+	if len(kept) != 1 || kept[0] != "1 stampy: heartbeat lookalike" {
+		t.Fatalf("unexpected stamped lines: %q", kept)
+	}
+	if len(dropped) != 1 || dropped[0] != "stampy: heartbeat 1970-01-01T00:00:00Z: ... no output for 30s" {
+		t.Fatalf("unexpected heartbeat lines: %q", dropped)
+	}
+}
+
+func TestJSONEmitterHeartbeat(t *testing.T) {
+	tpl, err := template.Parse("idle {idle:.0f}s")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	emitter := newJSONEmitter(tpl, &buf, "ts")
+	if err := emitter.emitHeartbeat(tpl, template.StampState{Idle: 30 * time.Second}); err != nil {
+		t.Fatalf("emitHeartbeat returned error: %v", err)
+	}
+
+	want := `{"heartbeat":true,"ts":"idle 30s"}` + "\n"
+	if buf.String() != want {
+		t.Fatalf("unexpected heartbeat output: got %q want %q", buf.String(), want)
+	}
+}
+
+func TestTextEmitterJSONTokens(t *testing.T) {
+	tpl, err := template.Parse(`{json:level:<5|"-"} {json:msg|"{}"}`)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	emitter := newTextEmitter(tpl, &buf)
+	for _, text := range []string{`{"level":"info","msg":"ready"}`, "not json"} {
+		rec := lineRecord{text: text, hasNewline: true, timestamp: time.Unix(0, 0)}
+		if err := emitter.emit(emission{record: rec, line: 1}); err != nil {
+			t.Fatalf("emit returned error: %v", err)
+		}
+	}
+
+	want := "info  ready\n-     {} not json\n"
+	if buf.String() != want {
+		t.Fatalf("unexpected output: got %q want %q", buf.String(), want)
+	}
+}
+
+func TestJSONLargeIntegersKeepTheirDigits(t *testing.T) {
+	input := `{"id":9007199254740993,"ratio":0.1,"big":1e400}` + "\n"
+
+	tpl, err := template.Parse(`{json:id} {json:ratio} {json:big} {if json:id > 1000}big{end}`)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	var text bytes.Buffer
+	clock := newFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	if err := processLines(strings.NewReader(input), &text, tpl, Options{}, clock, nil); err != nil {
+		t.Fatalf("processLines returned error: %v", err)
+	}
+	if want := "9007199254740993 0.1 1e400 big\n"; text.String() != want {
+		t.Fatalf("unexpected text output: got %q want %q", text.String(), want)
+	}
+
+	lineTpl, err := template.Parse("{line}")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	var jsonl bytes.Buffer
+	clock = newFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	if err := processLines(strings.NewReader(input), &jsonl, lineTpl, Options{JSONKey: "n"}, clock, nil); err != nil {
+		t.Fatalf("processLines returned error: %v", err)
+	}
+	if want := `{"big":1e400,"id":9007199254740993,"n":"1","ratio":0.1}` + "\n"; jsonl.String() != want {
+		t.Fatalf("unexpected JSONL output: got %q want %q", jsonl.String(), want)
+	}
+}
+
+func TestTextConditionInJSONLMode(t *testing.T) {
+	tpl, err := template.Parse(`{if text =~ "ERROR"}BAD{end}{line}`)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	var out bytes.Buffer
+	clock := newFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	input := "ERROR x\n" + `{"msg":"ERROR y"}` + "\nok\n"
+	if err := processLines(strings.NewReader(input), &out, tpl, Options{JSONKey: "ts"}, clock, nil); err != nil {
+		t.Fatalf("processLines returned error: %v", err)
+	}
+	want := `{"line":"ERROR x","ts":"BAD1"}` + "\n" + `{"msg":"ERROR y","ts":"BAD2"}` + "\n" + `{"line":"ok","ts":"3"}` + "\n"
+	if out.String() != want {
+		t.Fatalf("unexpected output: got %q want %q", out.String(), want)
+	}
+}
+
+func TestLineMetadataAcrossModes(t *testing.T) {
+	tpl, err := template.Parse("{offset}+{len}")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	input := "abc\n\nhello world\n"
+
+	var text bytes.Buffer
+	clock := newFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	if err := processLines(strings.NewReader(input), &text, tpl, Options{}, clock, nil); err != nil {
+		t.Fatalf("processLines returned error: %v", err)
+	}
+	if want := "0+3 abc\n4+0\n5+11 hello world\n"; text.String() != want {
+		t.Fatalf("unexpected text output: got %q want %q", text.String(), want)
+	}
+
+	var jsonl bytes.Buffer
+	clock = newFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	if err := processLines(strings.NewReader(`{"a":1}`+"\n"), &jsonl, tpl, Options{JSONKey: "at"}, clock, nil); err != nil {
+		t.Fatalf("processLines returned error: %v", err)
+	}
+	if want := `{"a":1,"at":"0+7"}` + "\n"; jsonl.String() != want {
+		t.Fatalf("unexpected JSONL output: got %q want %q", jsonl.String(), want)
+	}
+}
+
+func TestLineBufferSince(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	buffered := newLineBuffer()
+	buffered.push(lineRecord{timestamp: start})
+	buffered.push(lineRecord{timestamp: start.Add(time.Second)})
+	emit := buffered.push(lineRecord{timestamp: start.Add(4 * time.Second)})
+	if emit == nil || emit.since != time.Second || emit.delta != 3*time.Second {
+		t.Fatalf("unexpected buffered emission: %+v", emit)
+	}
+
+	immediate := newLineBuffer()
+	immediate.immediate = true
+	if emit := immediate.push(lineRecord{timestamp: start}); emit == nil || emit.since != 0 || emit.line != 1 {
+		t.Fatalf("expected the first line to be emitted at once, got %+v", emit)
+	}
+	emit = immediate.push(lineRecord{timestamp: start.Add(2 * time.Second)})
+	if emit == nil || emit.since != 2*time.Second || emit.delta != 0 || emit.elapsed != 2*time.Second {
+		t.Fatalf("unexpected immediate emission: %+v", emit)
+	}
+	if immediate.flush() != nil {
+		t.Fatalf("expected nothing pending in immediate mode")
+	}
+}
@@ -0,0 +1,38 @@
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// crockford is the Crockford base32 alphabet used by ULIDs.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newRunID returns a ULID for this invocation: 48 bits of millisecond time
+// followed by 80 random bits, encoded as 26 characters that sort by time.
+func newRunID(now time.Time, entropy io.Reader) (string, error) {
+	var id [16]byte
+	binary.BigEndian.PutUint64(id[:8], uint64(now.UnixMilli())<<16)
+	if _, err := io.ReadFull(entropy, id[6:]); err != nil {
+		return "", err
+	}
+
+	// 26 characters carry 130 bits; the first two are always zero.
+	var out [26]byte
+	for i := range out {
+		var value byte
+		for bit := i*5 - 2; bit < i*5+3; bit++ {
+			value <<= 1
+			if bit >= 0 && id[bit/8]&(0x80>>(bit%8)) != 0 {
+				value |= 1
+			}
+		}
+		out[i] = crockford[value]
+	}
+	return string(out[:]), nil
+}
+
+// defaultEntropy is the randomness source for run IDs.
+var defaultEntropy io.Reader = rand.Reader
@@ -0,0 +1,156 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// seqBlockSize is how many {seq} numbers a run reserves per lock of the
+// counter file.
+const seqBlockSize = 64
+
+// seqStore persists the {seq} counter between runs. A run reserves numbers in
+// blocks: under an exclusive lock it advances the file past the block, so
+// concurrent runs sharing the file never hand out the same number, and a run
+// that is killed skips at most the rest of its block. On Close an unused tail
+// is handed back when no other run has reserved since.
+type seqStore struct {
+	file *os.File
+	path string
+	// last is the number most recently handed out; limit is the end of the
+	// reserved block.
+	last, limit int64
+}
+
+// openSeqStore opens or creates the counter file at path, creating its parent
+// directories, and checks that it holds a sequence number.
+func openSeqStore(path string) (*seqStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("create sequence directory: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open sequence file: %w", err)
+	}
+	s := &seqStore{file: file, path: path}
+	err = s.locked(func() error {
+		_, err := s.read()
+		return err
+	})
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// next returns the next number of the reserved block, reserving a new block
+// after the last number recorded by any run once it runs out.
+func (s *seqStore) next() (int64, error) {
+	if s.last < s.limit {
+		s.last++
+		return s.last, nil
+	}
+	err := s.locked(func() error {
+		last, err := s.read()
+		if err != nil {
+			return err
+		}
+		if err := s.write(last + seqBlockSize); err != nil {
+			return err
+		}
+		s.last, s.limit = last, last+seqBlockSize
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	s.last++
+	return s.last, nil
+}
+
+// write records seq as the last number used. Values are zero-padded to a fixed
+// width so each write fully replaces the previous one.
+func (s *seqStore) write(seq int64) error {
+	if _, err := s.file.WriteAt([]byte(fmt.Sprintf("%020d\n", seq)), 0); err != nil {
+		return fmt.Errorf("write sequence file: %w", err)
+	}
+	return nil
+}
+
+// read returns the last recorded sequence number; an empty file counts as 0.
+func (s *seqStore) read() (int64, error) {
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("read sequence file: %w", err)
+	}
+	content, err := io.ReadAll(s.file)
+	if err != nil {
+		return 0, fmt.Errorf("read sequence file: %w", err)
+	}
+	text := strings.TrimSpace(string(content))
+	if text == "" {
+		return 0, nil
+	}
+	seq, err := strconv.ParseInt(text, 10, 64)
+	if err != nil || seq < 0 {
+		return 0, fmt.Errorf("sequence file %s does not contain a sequence number: %q", s.path, text)
+	}
+	return seq, nil
+}
+
+// locked runs fn while holding an exclusive lock on the counter file.
+func (s *seqStore) locked(fn func() error) error {
+	if err := lockFile(s.file); err != nil {
+		return fmt.Errorf("lock sequence file: %w", err)
+	}
+	defer unlockFile(s.file)
+	return fn()
+}
+
+// Close hands back the unused tail of the reserved block if the file still
+// ends at it, so consecutive runs number without gaps.
+func (s *seqStore) Close() error {
+	err := s.locked(func() error {
+		recorded, err := s.read()
+		if err != nil || recorded != s.limit || s.last == s.limit {
+			return err
+		}
+		return s.write(s.last)
+	})
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// defaultSeqPath is the counter file used when --seq-file is not given:
+// $XDG_STATE_HOME/stampy/seq, falling back to ~/.local/state/stampy/seq.
+func defaultSeqPath() (string, error) {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "stampy", "seq"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("locate sequence file: %w", err)
+	}
+	return filepath.Join(home, ".local", "state", "stampy", "seq"), nil
+}
+
+// seqEmitter claims each line's sequence number just before writing it.
+type seqEmitter struct {
+	emitter
+	store *seqStore
+}
+
+func (e seqEmitter) emit(em emission) error {
+	seq, err := e.store.next()
+	if err != nil {
+		return err
+	}
+	em.seq = seq
+	return e.emitter.emit(em)
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package internal
+
+import "os"
+
+// Without flock(2) the sequence file is not locked, so concurrent runs must
+// not share it.
+
+func lockFile(*os.File) error { return nil }
+
+func unlockFile(*os.File) error { return nil }
@@ -0,0 +1,195 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yiblet/stampy/internal/template"
+)
+
+func TestSeqContinuesAcrossRuns(t *testing.T) {
+	seqPath := filepath.Join(t.TempDir(), "state", "seq")
+	tpl, err := template.Parse("#{seq} {}")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var output bytes.Buffer
+	for _, input := range []string{"a\nb\n", "c\n"} {
+		clock := newFakeClock(base)
+		if err := processLines(strings.NewReader(input), &output, tpl, Options{SeqFile: seqPath}, clock, nil); err != nil {
+			t.Fatalf("processLines returned error: %v", err)
+		}
+	}
+
+	if want := "#1 a\n#2 b\n#3 c\n"; output.String() != want {
+		t.Fatalf("unexpected output: got %q want %q", output.String(), want)
+	}
+	data, err := os.ReadFile(seqPath)
+	if err != nil {
+		t.Fatalf("failed to read sequence file: %v", err)
+	}
+	if strings.TrimSpace(string(data)) != "00000000000000000003" {
+		t.Fatalf("unexpected sequence file contents: %q", data)
+	}
+}
+
+func TestSeqConcurrentRunsShareFile(t *testing.T) {
+	seqPath := filepath.Join(t.TempDir(), "seq")
+	tpl, err := template.Parse("{seq} {}")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+
+	// Each run needs several blocks, so reservations interleave.
+	const runs, lines = 8, 3*seqBlockSize + 10
+	input := strings.Repeat("x\n", lines)
+	outputs := make([]bytes.Buffer, runs)
+	errs := make(chan error, runs)
+	var wg sync.WaitGroup
+	for i := range outputs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			clock := newFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+			errs <- processLines(strings.NewReader(input), &outputs[i], tpl, Options{SeqFile: seqPath}, clock, nil)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("processLines returned error: %v", err)
+		}
+	}
+
+	seen := make(map[int64]bool)
+	var highest int64
+	for i := range outputs {
+		for _, line := range strings.Split(strings.TrimSpace(outputs[i].String()), "\n") {
+			field, _, _ := strings.Cut(line, " ")
+			seq, err := strconv.ParseInt(field, 10, 64)
+			if err != nil {
+				t.Fatalf("unexpected line %q", line)
+			}
+			if seen[seq] {
+				t.Fatalf("sequence number %d handed out twice", seq)
+			}
+			seen[seq] = true
+			highest = max(highest, seq)
+		}
+	}
+	if len(seen) != runs*lines {
+		t.Fatalf("expected %d distinct sequence numbers, got %d", runs*lines, len(seen))
+	}
+	data, err := os.ReadFile(seqPath)
+	if err != nil {
+		t.Fatalf("failed to read sequence file: %v", err)
+	}
+	// Unused block tails may leave gaps, but never below a number handed out.
+	recorded, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil || recorded < highest || recorded > int64(runs*(lines+seqBlockSize)) {
+		t.Fatalf("unexpected sequence file contents %q for highest number %d", data, highest)
+	}
+}
+
+func TestSeqStoreReservesBlocks(t *testing.T) {
+	seqPath := filepath.Join(t.TempDir(), "seq")
+	recorded := func() string {
+		t.Helper()
+		data, err := os.ReadFile(seqPath)
+		if err != nil {
+			t.Fatalf("failed to read sequence file: %v", err)
+		}
+		return strings.TrimLeft(strings.TrimSpace(string(data)), "0")
+	}
+	open := func() *seqStore {
+		t.Helper()
+		store, err := openSeqStore(seqPath)
+		if err != nil {
+			t.Fatalf("openSeqStore returned error: %v", err)
+		}
+		return store
+	}
+	next := func(store *seqStore, want int64) {
+		t.Helper()
+		if got, err := store.next(); err != nil || got != want {
+			t.Fatalf("next() = %d, %v; want %d", got, err, want)
+		}
+	}
+
+	first := open()
+	next(first, 1)
+	next(first, 2)
+	if got := recorded(); got != fmt.Sprint(seqBlockSize) {
+		t.Fatalf("expected the file to record the reserved block, got %q", got)
+	}
+
+	// A second run starts after the first run's block.
+	second := open()
+	next(second, seqBlockSize+1)
+
+	// The first run cannot hand back its tail once another run reserved past it.
+	if err := first.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+	if got := recorded(); got != fmt.Sprint(2*seqBlockSize) {
+		t.Fatalf("expected the second block to stay reserved, got %q", got)
+	}
+	if err := second.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+	if got := recorded(); got != fmt.Sprint(seqBlockSize+1) {
+		t.Fatalf("expected the last run to hand back its tail, got %q", got)
+	}
+}
+
+func TestSeqFileUntouchedWithoutSeqToken(t *testing.T) {
+	seqPath := filepath.Join(t.TempDir(), "seq")
+	tpl, err := template.Parse("{line} {}")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	clock := newFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	var output bytes.Buffer
+	if err := processLines(strings.NewReader("a\n"), &output, tpl, Options{SeqFile: seqPath}, clock, nil); err != nil {
+		t.Fatalf("processLines returned error: %v", err)
+	}
+	if _, err := os.Stat(seqPath); !os.IsNotExist(err) {
+		t.Fatalf("expected no sequence file, stat returned %v", err)
+	}
+}
+
+func TestOpenSeqStoreRejectsGarbage(t *testing.T) {
+	seqPath := filepath.Join(t.TempDir(), "seq")
+	if err := os.WriteFile(seqPath, []byte("not a number\n"), 0o644); err != nil {
+		t.Fatalf("failed to seed sequence file: %v", err)
+	}
+	if _, err := openSeqStore(seqPath); err == nil {
+		t.Fatalf("expected error for a corrupt sequence file")
+	}
+}
+
+func TestNewRunID(t *testing.T) {
+	now := time.UnixMilli(1469918176385)
+	entropy := bytes.NewReader(bytes.Repeat([]byte{0xff}, 10))
+	id, err := newRunID(now, entropy)
+	if err != nil {
+		t.Fatalf("newRunID returned error: %v", err)
+	}
+	if want := "01ARYZ6S41ZZZZZZZZZZZZZZZZ"; id != want {
+		t.Fatalf("unexpected run id: got %s want %s", id, want)
+	}
+
+	if _, err := newRunID(now, bytes.NewReader(nil)); err == nil {
+		t.Fatalf("expected error when entropy is exhausted")
+	}
+}
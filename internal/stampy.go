@@ -5,14 +5,19 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
-	"strings"
+	"regexp"
+	"strconv"
 	"time"
 
 	"github.com/yiblet/stampy/internal/template"
 )
 
-const defaultTemplate = "{iso}: {}"
+const (
+	defaultTemplate          = "{iso}: {}"
+	defaultHeartbeatTemplate = "{iso}: ... no output for {idle:.0f}s"
+)
 
 // Options captures the configuration used when running the timestamping workflow.
 type Options struct {
@@ -21,6 +26,69 @@ type Options struct {
 	Input            string
 	Output           string
 	JSONKey          string
+	// NoJSON keeps text mode even when STAMPY_JSON, a config file or a preset
+	// would enable JSONL output.
+	NoJSON        bool
+	MetricsListen string
+	// Heartbeat emits a synthetic line rendered from HeartbeatTemplate whenever no
+	// input has arrived for this long. Zero disables heartbeats.
+	Heartbeat         time.Duration
+	HeartbeatTemplate string
+	// IdleTimeout stops processing with ExitIdleTimeout when no input has arrived
+	// for this long. MaxDuration stops processing with ExitMaxDuration once the run
+	// has lasted this long. Zero disables either guard.
+	IdleTimeout time.Duration
+	MaxDuration time.Duration
+	// Color is "auto", "always" or "never". Auto enables ANSI colour only when the
+	// output is a terminal and NO_COLOR is unset. JSONL output is never coloured.
+	Color     string
+	WarnDelta time.Duration
+	CritDelta time.Duration
+	// Extract lists NAME=REGEX patterns whose captures are exposed as {field:NAME}
+	// and, in JSONL mode, merged into each object.
+	Extract []string
+	// TZ names the default zone for {time} and {iso} (e.g. "UTC" or
+	// "America/New_York"). Empty keeps the local zone.
+	TZ string
+	// Locale names the language of month and weekday names in {time} date
+	// directives (e.g. "de" or "ja_JP.UTF-8"). Empty means English.
+	Locale string
+	// SeqFile stores the {seq} counter between runs; empty uses the default
+	// state file. It is only touched when the template renders {seq}.
+	SeqFile string
+	// RunID is rendered by {run_id}; RunWithClock generates a ULID when empty.
+	RunID string
+	// Epoch is the reference time for {since_epoch}, as RFC 3339 or Unix seconds.
+	Epoch string
+	// StartAt re-anchors {elapsed} at the first line matching this regex.
+	StartAt string
+	// Presets are user-defined templates selectable as @name, alongside and
+	// overriding the built-in presets.
+	Presets map[string]Preset
+	// Timers lists NAME=REGEX stopwatches; {timer:NAME} renders the time since
+	// the last line matching REGEX.
+	Timers []string
+	// Delimiter separates input records: "lf" (the default), "crlf", "nul", or
+	// any string with backslash escapes. Output lines end with the same
+	// terminator as the input record.
+	Delimiter string
+}
+
+// Exit codes reported through GuardError when a runtime guard stops processing.
+const (
+	ExitIdleTimeout = 3
+	ExitMaxDuration = 4
+)
+
+// GuardError reports that processing was stopped by --idle-timeout or --max-duration.
+type GuardError struct {
+	Reason string
+	Limit  time.Duration
+	Code   int
+}
+
+func (e *GuardError) Error() string {
+	return fmt.Sprintf("%s (%s)", e.Reason, e.Limit)
 }
 
 // Run executes the timestamping workflow using the system clock.
@@ -30,15 +98,40 @@ func Run(opts Options) error {
 
 // RunWithClock executes the timestamping workflow with a provided clock, making it testable.
 func RunWithClock(opts Options, nowFn func() time.Time) (err error) {
+	opts, err = applyPreset(opts)
+	if err != nil {
+		return err
+	}
 	tplString := opts.Template
 	if !opts.TemplateProvided || tplString == "" {
 		tplString = defaultTemplate
 	}
 
-	tpl, err := template.Parse(tplString)
+	// The run ID records when the invocation started on the wall clock, not
+	// the stamping clock.
+	if opts.RunID == "" {
+		opts.RunID, err = newRunID(time.Now(), defaultEntropy)
+		if err != nil {
+			return fmt.Errorf("generate run id: %w", err)
+		}
+	}
+
+	// Only stdout can be a terminal; files named by --output never get colour.
+	var dest io.Writer
+	if opts.Output == "" {
+		dest = os.Stdout
+	}
+	cfg, err := templateConfig(opts, dest)
+	if err != nil {
+		return err
+	}
+	tpl, err := template.ParseWithConfig(tplString, cfg)
 	if err != nil {
 		return fmt.Errorf("parse template: %w", err)
 	}
+	if err := checkDeltaThresholds(opts, cfg, tpl); err != nil {
+		return err
+	}
 
 	reader, writer, cleanup, err := createIO(opts.Input, opts.Output)
 	if err != nil {
@@ -51,7 +144,125 @@ func RunWithClock(opts Options, nowFn func() time.Time) (err error) {
 		}
 	}()
 
-	return processLines(reader, writer, tpl, opts, nowFn)
+	var stats *lineMetrics
+	if opts.MetricsListen != "" {
+		stats = newLineMetrics(nowFn)
+		shutdown, err := serveMetrics(opts.MetricsListen, stats)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if serr := shutdown(); serr != nil && err == nil {
+				err = serr
+			}
+		}()
+	}
+
+	return processLines(reader, writer, tpl, opts, nowFn, stats)
+}
+
+// templateConfig derives the parse-time template settings for output written to writer.
+func templateConfig(opts Options, writer io.Writer) (template.Config, error) {
+	color, err := colorEnabled(opts, writer)
+	if err != nil {
+		return template.Config{}, err
+	}
+	var loc *time.Location
+	if opts.TZ != "" {
+		loc, err = time.LoadLocation(opts.TZ)
+		if err != nil {
+			return template.Config{}, fmt.Errorf("invalid time zone '%s': %w", opts.TZ, err)
+		}
+	}
+	var names *template.Locale
+	if opts.Locale != "" {
+		names, err = template.LookupLocale(opts.Locale)
+		if err != nil {
+			return template.Config{}, err
+		}
+	}
+	// Check the timer specs before the template refers to them.
+	if _, err := parseTimers(opts.Timers); err != nil {
+		return template.Config{}, err
+	}
+	var epoch time.Time
+	if opts.Epoch != "" {
+		epoch, err = parseEpoch(opts.Epoch)
+		if err != nil {
+			return template.Config{}, err
+		}
+	}
+	return template.Config{
+		Color:     color,
+		WarnDelta: opts.WarnDelta,
+		CritDelta: opts.CritDelta,
+		Location:  loc,
+		RunID:     opts.RunID,
+		Epoch:     epoch,
+		Timers:    timerNames(opts.Timers),
+		Locale:    names,
+	}, nil
+}
+
+// checkDeltaThresholds rejects {delta} colour thresholds that heartbeats make
+// unreachable: a heartbeat writes the pending line with {delta} measured up to
+// that heartbeat, so no delta exceeds the --heartbeat interval.
+func checkDeltaThresholds(opts Options, cfg template.Config, tpl template.Template) error {
+	if opts.Heartbeat <= 0 || !cfg.Color || !tpl.NeedsLookahead() {
+		return nil
+	}
+	for _, threshold := range []struct {
+		flag  string
+		value time.Duration
+	}{{"--warn-delta", cfg.WarnDelta}, {"--crit-delta", cfg.CritDelta}} {
+		if threshold.value >= opts.Heartbeat {
+			return fmt.Errorf("%s %s is never reached with --heartbeat %s, which caps {delta} at the heartbeat interval; lower %s, raise --heartbeat or use --color never",
+				threshold.flag, threshold.value, opts.Heartbeat, threshold.flag)
+		}
+	}
+	return nil
+}
+
+// parseEpoch reads an --epoch value: an RFC 3339 timestamp or Unix seconds,
+// optionally fractional.
+func parseEpoch(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		whole := math.Floor(seconds)
+		return time.Unix(int64(whole), int64((seconds-whole)*float64(time.Second))), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid epoch '%s': want an RFC 3339 time such as 2024-05-01T12:00:00Z or Unix seconds", value)
+}
+
+// colorEnabled resolves the colour mode against the destination writer.
+func colorEnabled(opts Options, writer io.Writer) (bool, error) {
+	switch opts.Color {
+	case "", "auto":
+		if opts.JSONKey != "" || os.Getenv("NO_COLOR") != "" {
+			return false, nil
+		}
+		return isTerminal(writer), nil
+	case "always":
+		return opts.JSONKey == "", nil
+	case "never":
+		return false, nil
+	default:
+		return false, fmt.Errorf("invalid color mode '%s' (want auto, always, or never)", opts.Color)
+	}
+}
+
+func isTerminal(writer io.Writer) bool {
+	f, ok := writer.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
 }
 
 // createIO wires up the appropriate reader and writer based on the provided
@@ -97,25 +308,247 @@ func createIO(in string, out string) (io.Reader, io.Writer, func() error, error)
 type lineRecord struct {
 	text       string
 	hasNewline bool
+	// terminator is the delimiter that ended the record, written back after
+	// it; empty means "\n" when hasNewline is set.
+	terminator string
 	timestamp  time.Time
+	fields     map[string]string
+	// offset is the byte offset of the line's first byte in the input.
+	offset int64
+	// anchor restarts {elapsed} at this line (--start-at).
+	anchor bool
+	// resets names the --timer stopwatches this line restarts.
+	resets []string
 }
 
-func processLines(reader io.Reader, writer io.Writer, tpl template.Template, opts Options, nowFn func() time.Time) error {
-	bufreader := bufio.NewReader(reader)
-	buffer := newLineBuffer()
+// ending is what follows the stamped line: the record's own terminator, a
+// newline for records without one, or nothing for an unterminated final line.
+func (r lineRecord) ending() string {
+	switch {
+	case !r.hasNewline:
+		return ""
+	case r.terminator != "":
+		return r.terminator
+	default:
+		return "\n"
+	}
+}
 
-	// Select emitter based on whether JSONL mode is enabled
-	var emitter interface {
-		emit(emission) error
+// emitter writes stamped lines in either text or JSONL form.
+type emitter interface {
+	emit(emission) error
+	emitHeartbeat(template.Template, template.StampState) error
+	// emitGuard writes the final marker when --idle-timeout or --max-duration fires.
+	emitGuard(template.StampState, *GuardError) error
+}
+
+type readResult struct {
+	line string
+	err  error
+}
+
+// readLines reads delimited records on a separate goroutine so the processing
+// loop can wake up on timers while input is quiet. The goroutine exits after the
+// final read or once done is closed.
+func readLines(reader io.Reader, delim delimiter, done <-chan struct{}) <-chan readResult {
+	results := make(chan readResult)
+	go func() {
+		defer close(results)
+		bufreader := bufio.NewReader(reader)
+		for {
+			line, err := delim.read(bufreader)
+			select {
+			case results <- readResult{line: line, err: err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return results
+}
+
+// lineRun holds the per-run setup derived from Options: how input is split,
+// what each record is matched against, and where stamped lines go.
+type lineRun struct {
+	delim      delimiter
+	extractors []fieldExtractor
+	timers     []stopwatch
+	// startAt matches the line that re-anchors {elapsed}; nil once it has fired.
+	startAt *regexp.Regexp
+	out     emitter
+	buffer  *lineBuffer
+	// heartbeat renders idle lines when --heartbeat is set.
+	heartbeat template.Template
+	// closers release resources such as the {seq} store when the run ends.
+	closers []func() error
+}
+
+// newLineRun parses the record-level options and builds the emitter for writer.
+func newLineRun(writer io.Writer, tpl template.Template, opts Options, stats *lineMetrics) (*lineRun, error) {
+	run := &lineRun{buffer: newLineBuffer()}
+	run.buffer.immediate = !tpl.NeedsLookahead()
+
+	var err error
+	if run.delim, err = parseDelimiter(opts.Delimiter); err != nil {
+		return nil, err
+	}
+	if run.extractors, err = parseExtractors(opts.Extract); err != nil {
+		return nil, err
+	}
+	if run.timers, err = parseTimers(opts.Timers); err != nil {
+		return nil, err
 	}
+	for _, timer := range run.timers {
+		run.buffer.timerNames = append(run.buffer.timerNames, timer.name)
+	}
+	if opts.StartAt != "" {
+		if run.startAt, err = regexp.Compile(opts.StartAt); err != nil {
+			return nil, fmt.Errorf("invalid --start-at pattern: %w", err)
+		}
+	}
+
+	// Select emitter based on whether JSONL mode is enabled
 	if opts.JSONKey != "" {
-		emitter = newJSONEmitter(tpl, writer, opts.JSONKey)
+		jsonOut := newJSONEmitter(tpl, writer, opts.JSONKey)
+		jsonOut.stats = stats
+		jsonOut.eol = run.delim.eol()
+		run.out = jsonOut
 	} else {
-		emitter = newTextEmitter(tpl, writer)
+		textOut := newTextEmitter(tpl, writer)
+		textOut.eol = run.delim.eol()
+		run.out = textOut
+	}
+
+	if tpl.NeedsSeq() {
+		path := opts.SeqFile
+		if path == "" {
+			if path, err = defaultSeqPath(); err != nil {
+				return nil, err
+			}
+		}
+		store, err := openSeqStore(path)
+		if err != nil {
+			return nil, err
+		}
+		run.closers = append(run.closers, store.Close)
+		run.out = seqEmitter{emitter: run.out, store: store}
+	}
+
+	if opts.Heartbeat > 0 {
+		tplString := opts.HeartbeatTemplate
+		if tplString == "" {
+			tplString = defaultHeartbeatTemplate
+		}
+		cfg, err := templateConfig(opts, writer)
+		if err != nil {
+			run.close()
+			return nil, err
+		}
+		if run.heartbeat, err = template.ParseWithConfig(tplString, cfg); err != nil {
+			run.close()
+			return nil, fmt.Errorf("parse heartbeat template: %w", err)
+		}
+	}
+	return run, nil
+}
+
+// record builds the lineRecord for one raw record read at offset.
+func (r *lineRun) record(raw string, offset int64, now time.Time) lineRecord {
+	text, terminator := r.delim.split(raw)
+	record := lineRecord{
+		text:       text,
+		hasNewline: terminator != "",
+		terminator: terminator,
+		timestamp:  now,
+		offset:     offset,
+		fields:     extractFields(r.extractors, text),
+		resets:     matchTimers(r.timers, text),
+	}
+	if r.startAt != nil && r.startAt.MatchString(text) {
+		record.anchor = true
+		r.startAt = nil
+	}
+	return record
+}
+
+// push buffers record and writes whichever line it releases.
+func (r *lineRun) push(record lineRecord) error {
+	if emit := r.buffer.push(record); emit != nil {
+		return r.out.emit(*emit)
+	}
+	return nil
+}
+
+func (r *lineRun) close() error {
+	var errs []error
+	for _, close := range r.closers {
+		errs = append(errs, close())
+	}
+	return errors.Join(errs...)
+}
+
+func processLines(reader io.Reader, writer io.Writer, tpl template.Template, opts Options, nowFn func() time.Time, stats *lineMetrics) (err error) {
+	run, err := newLineRun(writer, tpl, opts, stats)
+	if err != nil {
+		return err
 	}
+	defer func() {
+		if cerr := run.close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+
+	var lastInput time.Time
+	if opts.Heartbeat > 0 {
+		lastInput = nowFn()
+	}
+	heartbeat, heartbeatC := startTimer(opts.Heartbeat)
+	defer stopTimer(heartbeat)
+	idle, idleC := startTimer(opts.IdleTimeout)
+	defer stopTimer(idle)
+	deadline, deadlineC := startTimer(opts.MaxDuration)
+	defer stopTimer(deadline)
+
+	done := make(chan struct{})
+	defer close(done)
+	lines := readLines(reader, run.delim, done)
+	var offset int64
 
 	for {
-		line, err := bufreader.ReadString('\n')
+		var result readResult
+		select {
+		case result = <-lines:
+		case <-heartbeatC:
+			now := nowFn()
+			if emit := run.buffer.release(now); emit != nil {
+				if err := run.out.emit(*emit); err != nil {
+					return err
+				}
+			}
+			state := template.StampState{Now: now, Idle: now.Sub(lastInput)}
+			if err := run.out.emitHeartbeat(run.heartbeat, state); err != nil {
+				return err
+			}
+			heartbeat.Reset(opts.Heartbeat)
+			continue
+		case <-idleC:
+			return stopLines(run, nowFn(), &GuardError{
+				Reason: "idle timeout: no input received",
+				Limit:  opts.IdleTimeout,
+				Code:   ExitIdleTimeout,
+			})
+		case <-deadlineC:
+			return stopLines(run, nowFn(), &GuardError{
+				Reason: "max duration exceeded",
+				Limit:  opts.MaxDuration,
+				Code:   ExitMaxDuration,
+			})
+		}
+
+		line, err := result.line, result.err
 		if err != nil && !errors.Is(err, io.EOF) {
 			return fmt.Errorf("read line: %w", err)
 		}
@@ -124,16 +557,15 @@ func processLines(reader io.Reader, writer io.Writer, tpl template.Template, opt
 			break
 		}
 
-		record := lineRecord{
-			text:       strings.TrimSuffix(line, "\n"),
-			hasNewline: strings.HasSuffix(line, "\n"),
-			timestamp:  nowFn(),
-		}
+		record := run.record(line, offset, nowFn())
+		offset += int64(len(line))
+		stats.observeLine(len(line), record.timestamp)
+		lastInput = record.timestamp
+		resetTimer(heartbeat, opts.Heartbeat)
+		resetTimer(idle, opts.IdleTimeout)
 
-		if emit := buffer.push(record); emit != nil {
-			if err := emitter.emit(*emit); err != nil {
-				return err
-			}
+		if err := run.push(record); err != nil {
+			return err
 		}
 
 		if errors.Is(err, io.EOF) {
@@ -141,11 +573,50 @@ func processLines(reader io.Reader, writer io.Writer, tpl template.Template, opt
 		}
 	}
 
-	if emit := buffer.flush(); emit != nil {
-		if err := emitter.emit(*emit); err != nil {
+	return finishLines(run.buffer, run.out)
+}
+
+// stopLines writes the pending line, with its delta measured up to now, then a
+// final marker describing the guard that fired, and returns the guard error.
+// The marker bypasses the line buffer so it takes no {line} or {seq} number.
+func stopLines(run *lineRun, now time.Time, guard *GuardError) error {
+	if emit := run.buffer.release(now); emit != nil {
+		if err := run.out.emit(*emit); err != nil {
 			return err
 		}
 	}
+	if err := run.out.emitGuard(template.StampState{Now: now}, guard); err != nil {
+		return err
+	}
+	return guard
+}
+
+// startTimer starts a timer for d, returning nil values when d is not positive so
+// the corresponding select case never fires.
+func startTimer(d time.Duration) (*time.Timer, <-chan time.Time) {
+	if d <= 0 {
+		return nil, nil
+	}
+	timer := time.NewTimer(d)
+	return timer, timer.C
+}
 
+func resetTimer(timer *time.Timer, d time.Duration) {
+	if timer != nil {
+		timer.Reset(d)
+	}
+}
+
+func stopTimer(timer *time.Timer) {
+	if timer != nil {
+		timer.Stop()
+	}
+}
+
+// finishLines flushes the final buffered line once input is exhausted.
+func finishLines(buffer *lineBuffer, out emitter) error {
+	if emit := buffer.flush(); emit != nil {
+		return out.emit(*emit)
+	}
 	return nil
 }
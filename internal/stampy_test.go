@@ -3,9 +3,12 @@ package internal
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -75,7 +78,7 @@ func TestProcessLinesElapsedAndDelta(t *testing.T) {
 	input := strings.NewReader("first line\nsecond line\n")
 	var output bytes.Buffer
 
-	if err := processLines(input, &output, tpl, Options{}, clock); err != nil {
+	if err := processLines(input, &output, tpl, Options{}, clock, nil); err != nil {
 		t.Fatalf("processLines returned error: %v", err)
 	}
 
@@ -104,7 +107,7 @@ func TestProcessLinesRespectsMissingTrailingNewline(t *testing.T) {
 	input := strings.NewReader("no newline")
 	var output bytes.Buffer
 
-	if err := processLines(input, &output, tpl, Options{}, clock); err != nil {
+	if err := processLines(input, &output, tpl, Options{}, clock, nil); err != nil {
 		t.Fatalf("processLines returned error: %v", err)
 	}
 
@@ -126,7 +129,7 @@ func TestProcessLinesSingleLineWithNewline(t *testing.T) {
 	input := strings.NewReader("only line\n")
 	var output bytes.Buffer
 
-	if err := processLines(input, &output, tpl, Options{}, clock); err != nil {
+	if err := processLines(input, &output, tpl, Options{}, clock, nil); err != nil {
 		t.Fatalf("processLines returned error: %v", err)
 	}
 
@@ -199,6 +202,52 @@ func TestRunWithClockInvalidTemplate(t *testing.T) {
 	}
 }
 
+func TestRunWithClockRejectsUnreachableDeltaThresholds(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.log")
+	if err := os.WriteFile(input, []byte("a\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	base := Options{
+		TemplateProvided: true,
+		Input:            input,
+		Output:           filepath.Join(dir, "out.log"),
+		Heartbeat:        30 * time.Second,
+		WarnDelta:        time.Second,
+		CritDelta:        60 * time.Second,
+	}
+
+	cases := []struct {
+		name     string
+		template string
+		color    string
+		crit     time.Duration
+		wantErr  bool
+	}{
+		{name: "crit beyond heartbeat", template: "{delta} {}", color: "always", crit: 60 * time.Second, wantErr: true},
+		{name: "crit at heartbeat", template: "{delta} {}", color: "always", crit: 30 * time.Second, wantErr: true},
+		{name: "crit below heartbeat", template: "{delta} {}", color: "always", crit: 20 * time.Second},
+		{name: "no colour", template: "{delta} {}", color: "never", crit: 60 * time.Second},
+		{name: "no delta", template: "{elapsed} {}", color: "always", crit: 60 * time.Second},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := base
+			opts.Template, opts.Color, opts.CritDelta = tc.template, tc.color, tc.crit
+			err := RunWithClock(opts, newFakeClock(time.Date(2024, 8, 1, 0, 0, 0, 0, time.UTC)))
+			if tc.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "--crit-delta") {
+					t.Fatalf("expected a --crit-delta error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("RunWithClock returned error: %v", err)
+			}
+		})
+	}
+}
+
 func newFakeClock(times ...time.Time) func() time.Time {
 	if len(times) == 0 {
 		panic("newFakeClock requires at least one time value")
@@ -327,7 +376,7 @@ func TestProcessLinesJSONLModeWithComplexTemplate(t *testing.T) {
 	var output bytes.Buffer
 
 	opts := Options{JSONKey: "event_time"}
-	if err := processLines(input, &output, tpl, opts, clock); err != nil {
+	if err := processLines(input, &output, tpl, opts, clock, nil); err != nil {
 		t.Fatalf("processLines returned error: %v", err)
 	}
 
@@ -379,7 +428,7 @@ func TestProcessLinesJSONLModePreservesNewlineHandling(t *testing.T) {
 	var output bytes.Buffer
 
 	opts := Options{JSONKey: "ts"}
-	if err := processLines(input, &output, tpl, opts, clock); err != nil {
+	if err := processLines(input, &output, tpl, opts, clock, nil); err != nil {
 		t.Fatalf("processLines returned error: %v", err)
 	}
 
@@ -393,3 +442,311 @@ func TestProcessLinesJSONLModePreservesNewlineHandling(t *testing.T) {
 		t.Fatalf("expected %q, got %q", expected, result)
 	}
 }
+
+func TestProcessLinesEmitsHeartbeatWhenIdle(t *testing.T) {
+	base := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	clock := newFakeClock(base, base, base.Add(5*time.Second), base.Add(6*time.Second))
+
+	tpl, err := template.Parse("{delta:.0f} {}")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+
+	pr, pw := io.Pipe()
+	output := &syncBuffer{}
+	opts := Options{Heartbeat: 50 * time.Millisecond, HeartbeatTemplate: "hb {idle:.0f}s"}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- processLines(pr, output, tpl, opts, clock, nil)
+	}()
+
+	if _, err := io.WriteString(pw, "a\n"); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	waitFor(t, func() bool { return strings.Contains(output.String(), "hb ") })
+	if _, err := io.WriteString(pw, "b\n"); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	pw.Close()
+
+	if err := <-done; err != nil {
+		t.Fatalf("processLines returned error: %v", err)
+	}
+
+	want := "5 a\nstampy: heartbeat hb 5s\n0 b\n"
+	if output.String() != want {
+		t.Fatalf("unexpected output: got %q want %q", output.String(), want)
+	}
+}
+
+func TestProcessLinesInvalidHeartbeatTemplate(t *testing.T) {
+	clock := newFakeClock(time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC))
+
+	tpl, err := template.Parse("{}")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+
+	opts := Options{Heartbeat: time.Second, HeartbeatTemplate: "{idle"}
+	if err := processLines(strings.NewReader(""), io.Discard, tpl, opts, clock, nil); err == nil {
+		t.Fatalf("expected heartbeat template parse error")
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for a concurrent writer and reader.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.String()
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestProcessLinesIdleTimeout(t *testing.T) {
+	base := time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC)
+	clock := newFakeClock(base, base.Add(2*time.Second))
+
+	tpl, err := template.Parse("{delta:.0f} {}")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go io.WriteString(pw, "working\n")
+
+	var output bytes.Buffer
+	opts := Options{IdleTimeout: 30 * time.Millisecond}
+	err = processLines(pr, &output, tpl, opts, clock, nil)
+
+	var guard *GuardError
+	if !errors.As(err, &guard) || guard.Code != ExitIdleTimeout {
+		t.Fatalf("expected idle timeout guard error, got %v", err)
+	}
+
+	want := "2 working\nstampy: idle timeout: no input received (30ms)\n"
+	if output.String() != want {
+		t.Fatalf("unexpected output: got %q want %q", output.String(), want)
+	}
+}
+
+func TestProcessLinesGuardMarkerJSONL(t *testing.T) {
+	base := time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC)
+	clock := newFakeClock(base, base.Add(2*time.Second))
+	stats := newLineMetrics(clock)
+
+	tpl, err := template.Parse("{line}")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go io.WriteString(pw, `{"msg":"working"}`+"\n")
+
+	var output bytes.Buffer
+	opts := Options{IdleTimeout: 30 * time.Millisecond, JSONKey: "n"}
+	err = processLines(pr, &output, tpl, opts, clock, stats)
+
+	var guard *GuardError
+	if !errors.As(err, &guard) || guard.Code != ExitIdleTimeout {
+		t.Fatalf("expected idle timeout guard error, got %v", err)
+	}
+	want := `{"msg":"working","n":"1"}` + "\n" +
+		`{"exit_code":3,"guard":"idle timeout: no input received (30ms)","n":"0"}` + "\n"
+	if output.String() != want {
+		t.Fatalf("unexpected output: got %q want %q", output.String(), want)
+	}
+	if stats.lines != 1 || stats.jsonFailures != 0 {
+		t.Fatalf("guard marker counted as input: lines=%d json failures=%d", stats.lines, stats.jsonFailures)
+	}
+}
+
+func TestProcessLinesMaxDuration(t *testing.T) {
+	clock := newFakeClock(time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC))
+
+	tpl, err := template.Parse("{}")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+
+	var output bytes.Buffer
+	opts := Options{MaxDuration: 20 * time.Millisecond, IdleTimeout: time.Minute}
+	err = processLines(pr, &output, tpl, opts, clock, nil)
+
+	var guard *GuardError
+	if !errors.As(err, &guard) || guard.Code != ExitMaxDuration {
+		t.Fatalf("expected max duration guard error, got %v", err)
+	}
+	if output.String() != "stampy: max duration exceeded (20ms)\n" {
+		t.Fatalf("unexpected output: %q", output.String())
+	}
+}
+
+func TestColorEnabled(t *testing.T) {
+	var buf bytes.Buffer
+
+	cases := []struct {
+		name string
+		opts Options
+		want bool
+	}{
+		{name: "auto non-terminal", opts: Options{}, want: false},
+		{name: "always", opts: Options{Color: "always"}, want: true},
+		{name: "always json", opts: Options{Color: "always", JSONKey: "ts"}, want: false},
+		{name: "never", opts: Options{Color: "never"}, want: false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := colorEnabled(tc.opts, &buf)
+			if err != nil {
+				t.Fatalf("colorEnabled returned error: %v", err)
+			}
+			if got != tc.want {
+				t.Fatalf("colorEnabled = %v, want %v", got, tc.want)
+			}
+		})
+	}
+
+	if _, err := colorEnabled(Options{Color: "sometimes"}, &buf); err == nil {
+		t.Fatalf("expected error for invalid colour mode")
+	}
+}
+
+func TestRunWithClockTimeZone(t *testing.T) {
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "input.txt")
+	outputPath := filepath.Join(dir, "output.txt")
+
+	if err := os.WriteFile(inputPath, []byte("hello\n"), 0o644); err != nil {
+		t.Fatalf("failed to seed input file: %v", err)
+	}
+
+	clock := newFakeClock(time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC))
+	opts := Options{Input: inputPath, Output: outputPath, TZ: "Europe/Berlin"}
+	if err := RunWithClock(opts, clock); err != nil {
+		t.Fatalf("RunWithClock returned error: %v", err)
+	}
+
+	data, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatalf("failed to read output file: %v", err)
+	}
+	if string(data) != "2024-07-01T02:00:00+02:00: hello\n" {
+		t.Fatalf("unexpected output: %q", string(data))
+	}
+
+	if err := RunWithClock(Options{TZ: "Nowhere/Special"}, clock); err == nil {
+		t.Fatalf("expected error for unknown time zone")
+	}
+}
+
+func TestProcessLinesEmitsImmediatelyWithoutDelta(t *testing.T) {
+	base := time.Date(2024, 5, 3, 0, 0, 0, 0, time.UTC)
+	clock := newFakeClock(base, base.Add(1500*time.Millisecond))
+
+	tpl, err := template.Parse("+{since:.1f}s {}")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+
+	pr, pw := io.Pipe()
+	output := &syncBuffer{}
+	done := make(chan error, 1)
+	go func() {
+		done <- processLines(pr, output, tpl, Options{}, clock, nil)
+	}()
+
+	// The first line must appear before the second one is written.
+	if _, err := io.WriteString(pw, "first\n"); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	waitFor(t, func() bool { return output.String() == "+0.0s first\n" })
+
+	if _, err := io.WriteString(pw, "second\n"); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	pw.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("processLines returned error: %v", err)
+	}
+	if want := "+0.0s first\n+1.5s second\n"; output.String() != want {
+		t.Fatalf("unexpected output: got %q want %q", output.String(), want)
+	}
+}
+
+func TestProcessLinesStartAt(t *testing.T) {
+	base := time.Date(2024, 5, 4, 0, 0, 0, 0, time.UTC)
+	times := []time.Time{base, base.Add(2 * time.Second), base.Add(5 * time.Second), base.Add(6 * time.Second), base.Add(9 * time.Second)}
+
+	input := "boot\nwarming up\nStarting test\nstep\nStarting test again\n"
+	for _, tc := range []struct {
+		tpl  string
+		want string
+	}{
+		{tpl: "{elapsed:.0f} {}", want: "0 boot\n2 warming up\n0 Starting test\n1 step\n4 Starting test again\n"},
+		{tpl: "{elapsed:.0f}/{delta:.0f} {}", want: "0/2 boot\n2/3 warming up\n0/1 Starting test\n1/3 step\n4/0 Starting test again\n"},
+	} {
+		tpl, err := template.Parse(tc.tpl)
+		if err != nil {
+			t.Fatalf("parse failed: %v", err)
+		}
+		var output bytes.Buffer
+		if err := processLines(strings.NewReader(input), &output, tpl, Options{StartAt: "^Starting"}, newFakeClock(times...), nil); err != nil {
+			t.Fatalf("processLines returned error: %v", err)
+		}
+		if output.String() != tc.want {
+			t.Fatalf("unexpected output for %q: got %q want %q", tc.tpl, output.String(), tc.want)
+		}
+	}
+
+	tpl, _ := template.Parse("{}")
+	if err := processLines(strings.NewReader(""), io.Discard, tpl, Options{StartAt: "("}, newFakeClock(base), nil); err == nil {
+		t.Fatalf("expected error for an invalid --start-at pattern")
+	}
+}
+
+func TestParseEpoch(t *testing.T) {
+	cases := map[string]time.Time{
+		"2024-05-01T12:00:00Z":        time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		"2024-05-01T14:00:00.5+02:00": time.Date(2024, 5, 1, 12, 0, 0, 500_000_000, time.UTC),
+		"1714564800":                  time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		"1714564800.25":               time.Date(2024, 5, 1, 12, 0, 0, 250_000_000, time.UTC),
+	}
+	for input, want := range cases {
+		got, err := parseEpoch(input)
+		if err != nil {
+			t.Fatalf("parseEpoch(%q) returned error: %v", input, err)
+		}
+		if !got.Equal(want) {
+			t.Fatalf("parseEpoch(%q) = %v, want %v", input, got, want)
+		}
+	}
+	if _, err := parseEpoch("yesterday"); err == nil {
+		t.Fatalf("expected error for an invalid epoch")
+	}
+}
@@ -0,0 +1,67 @@
+package template
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const ansiReset = "\x1b[0m"
+
+var ansiCodes = map[string]string{
+	"bold":      "1",
+	"dim":       "2",
+	"italic":    "3",
+	"underline": "4",
+	"black":     "30",
+	"red":       "31",
+	"green":     "32",
+	"yellow":    "33",
+	"blue":      "34",
+	"magenta":   "35",
+	"cyan":      "36",
+	"white":     "37",
+	"gray":      "90",
+	"grey":      "90",
+}
+
+// ansiSequence converts a comma-separated list of style names (e.g. "bold,red")
+// into a single SGR escape sequence.
+func ansiSequence(spec string) (string, error) {
+	if spec == "" {
+		return "", fmt.Errorf("color token requires a style such as {color:red}")
+	}
+	codes := []string{}
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		code, ok := ansiCodes[name]
+		if !ok {
+			return "", fmt.Errorf("unknown color '%s'", name)
+		}
+		codes = append(codes, code)
+	}
+	return "\x1b[" + strings.Join(codes, ";") + "m", nil
+}
+
+// deltaStyle highlights slow lines: yellow above warn, red above crit.
+func deltaStyle(warn, crit time.Duration) func(StampState) string {
+	yellow := "\x1b[" + ansiCodes["yellow"] + "m"
+	red := "\x1b[" + ansiCodes["red"] + "m"
+	return func(state StampState) string {
+		switch {
+		case crit > 0 && state.Delta > crit:
+			return red
+		case warn > 0 && state.Delta > warn:
+			return yellow
+		default:
+			return ""
+		}
+	}
+}
+
+func enabled(color bool, code string) string {
+	if !color {
+		return ""
+	}
+	return code
+}
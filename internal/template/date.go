@@ -2,14 +2,34 @@ package template
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 )
 
-var dateMappings = map[byte]string{
+// dateChunk appends one piece of a date(1)-style layout for t.
+type dateChunk func(b *strings.Builder, t time.Time)
+
+// dateFormat renders a compiled date(1)-style layout such as "%Y-%m-%d".
+// Directives without a Go layout equivalent (%s, %N, %u, %V, ...) are rendered
+// directly, and literal text is copied verbatim.
+type dateFormat []dateChunk
+
+func (f dateFormat) format(t time.Time) string {
+	var b strings.Builder
+	for _, chunk := range f {
+		chunk(&b, t)
+	}
+	return b.String()
+}
+
+// goLayoutDirectives map to a Go layout fragment rendered with time.Format.
+var goLayoutDirectives = map[byte]string{
 	'Y': "2006",
 	'y': "06",
 	'm': "01",
 	'd': "02",
+	'e': "_2",
 	'H': "15",
 	'I': "03",
 	'M': "04",
@@ -17,51 +37,167 @@ var dateMappings = map[byte]string{
 	'z': "-0700",
 	'Z': "MST",
 	'j': "002",
-	'b': "Jan",
-	'B': "January",
-	'a': "Mon",
-	'A': "Monday",
-	'p': "PM",
 }
 
-func convertDateLayout(layout string) (string, error) {
-	var b strings.Builder
+// compositeDirectives expand to other directives.
+var compositeDirectives = map[byte]string{
+	'F': "%Y-%m-%d",
+	'T': "%H:%M:%S",
+	'D': "%m/%d/%y",
+	'R': "%H:%M",
+	'r': "%I:%M:%S %p",
+	'c': "%a %b %e %H:%M:%S %Y",
+	'x': "%m/%d/%y",
+	'X': "%H:%M:%S",
+}
+
+// computedDirectives have no Go layout equivalent and are rendered directly.
+var computedDirectives = map[byte]func(t time.Time) string{
+	'C': func(t time.Time) string { return fmt.Sprintf("%02d", t.Year()/100) },
+	'k': func(t time.Time) string { return fmt.Sprintf("%2d", t.Hour()) },
+	'l': func(t time.Time) string { return fmt.Sprintf("%2d", hour12(t)) },
+	's': func(t time.Time) string { return strconv.FormatInt(t.Unix(), 10) },
+	'N': func(t time.Time) string { return fmt.Sprintf("%09d", t.Nanosecond()) },
+	'u': func(t time.Time) string { return strconv.Itoa((int(t.Weekday())+6)%7 + 1) },
+	'w': func(t time.Time) string { return strconv.Itoa(int(t.Weekday())) },
+	'U': func(t time.Time) string { return fmt.Sprintf("%02d", (t.YearDay()+6-int(t.Weekday()))/7) },
+	'W': func(t time.Time) string { return fmt.Sprintf("%02d", (t.YearDay()+6-(int(t.Weekday())+6)%7)/7) },
+	'V': func(t time.Time) string { _, week := t.ISOWeek(); return fmt.Sprintf("%02d", week) },
+	'G': func(t time.Time) string { year, _ := t.ISOWeek(); return strconv.Itoa(year) },
+	'g': func(t time.Time) string { year, _ := t.ISOWeek(); return fmt.Sprintf("%02d", year%100) },
+	'n': func(time.Time) string { return "\n" },
+	't': func(time.Time) string { return "\t" },
+}
+
+// suggestDateDirective proposes a supported directive for an unknown one: the
+// same letter in the other case, or our spelling of a directive from another
+// strftime dialect.
+func suggestDateDirective(directive byte) string {
+	if alias, ok := dateDirectiveAliases[directive]; ok {
+		return alias
+	}
+	if swapped := directive ^ 0x20; isASCIILetter(directive) && isDateDirective(swapped) {
+		return "%" + string(swapped)
+	}
+	return ""
+}
+
+// dateDirectiveAliases maps directives from other strftime dialects to ours.
+var dateDirectiveAliases = map[byte]string{
+	'L': "%3N", // Ruby milliseconds
+}
+
+func isASCIILetter(ch byte) bool {
+	return ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z'
+}
+
+func isDateDirective(ch byte) bool {
+	_, layout := goLayoutDirectives[ch]
+	_, composite := compositeDirectives[ch]
+	_, computed := computedDirectives[ch]
+	_, localized := localizedDirectives[ch]
+	return layout || composite || computed || localized || ch == 'f'
+}
+
+func hour12(t time.Time) int {
+	h := t.Hour() % 12
+	if h == 0 {
+		return 12
+	}
+	return h
+}
+
+// compileDateLayout compiles a date(1)-style layout into a dateFormat, taking
+// month and weekday names from names (English when nil).
+func compileDateLayout(layout string, names *Locale) (dateFormat, error) {
+	if names == nil {
+		names, _ = LookupLocale("en")
+	}
+	var chunks dateFormat
+	var literal strings.Builder
 	var last byte
+
+	flushLiteral := func() {
+		if literal.Len() == 0 {
+			return
+		}
+		text := literal.String()
+		chunks = append(chunks, func(b *strings.Builder, _ time.Time) { b.WriteString(text) })
+		literal.Reset()
+	}
+	addFunc := func(fn func(time.Time) string) {
+		flushLiteral()
+		chunks = append(chunks, func(b *strings.Builder, t time.Time) { b.WriteString(fn(t)) })
+		last = 0
+	}
+
 	for i := 0; i < len(layout); i++ {
 		ch := layout[i]
 		if ch != '%' {
-			b.WriteByte(ch)
+			literal.WriteByte(ch)
 			last = ch
 			continue
 		}
+		start := i
 		i++
 		if i >= len(layout) {
-			return "", fmt.Errorf("incomplete date directive at end of layout")
+			return nil, &spanError{offset: start, length: 1, msg: "incomplete date directive at end of layout"}
 		}
 		directive := layout[i]
-		if directive == '%' {
-			b.WriteByte('%')
-			last = '%'
-			continue
+
+		// %3N and %3f style: a digit selects how many fractional-second digits
+		// to keep.
+		digits := 0
+		if directive >= '1' && directive <= '9' && i+1 < len(layout) && (layout[i+1] == 'N' || layout[i+1] == 'f') {
+			digits = int(directive - '0')
+			i++
+			directive = layout[i]
 		}
-		if directive == 'f' {
-			// `%f` from date(1) represents microseconds; Go layouts use an explicit fractional
-			// second pattern so we ensure exactly one '.' precedes six zeros.
+
+		switch {
+		case directive == '%':
+			literal.WriteByte('%')
+			last = '%'
+		case directive == 'f':
+			// `%f` represents microseconds (`%3f` milliseconds, `%9f` nanoseconds);
+			// as with Go layouts we ensure exactly one '.' precedes the digits.
 			if last != '.' {
-				b.WriteByte('.')
+				literal.WriteByte('.')
 			}
-			b.WriteString("000000")
-			last = '0'
-			continue
-		}
-		goLayout, ok := dateMappings[directive]
-		if !ok {
-			return "", fmt.Errorf("unsupported date directive '%%%c'", directive)
-		}
-		b.WriteString(goLayout)
-		if len(goLayout) > 0 {
-			last = goLayout[len(goLayout)-1]
+			if digits == 0 {
+				digits = 6
+			}
+			addFunc(func(t time.Time) string { return fmt.Sprintf("%09d", t.Nanosecond())[:digits] })
+		case directive == 'N' && digits > 0:
+			addFunc(func(t time.Time) string { return fmt.Sprintf("%09d", t.Nanosecond())[:digits] })
+		case directive == ':' && i+1 < len(layout) && layout[i+1] == 'z':
+			i++
+			addFunc(func(t time.Time) string { return t.Format("-07:00") })
+		default:
+			if goLayout, ok := goLayoutDirectives[directive]; ok {
+				addFunc(func(t time.Time) string { return t.Format(goLayout) })
+				continue
+			}
+			if expansion, ok := compositeDirectives[directive]; ok {
+				sub, err := compileDateLayout(expansion, names)
+				if err != nil {
+					return nil, err
+				}
+				addFunc(sub.format)
+				continue
+			}
+			if fn, ok := computedDirectives[directive]; ok {
+				addFunc(fn)
+				continue
+			}
+			if fn, ok := localizedDirectives[directive]; ok {
+				addFunc(func(t time.Time) string { return fn(names, t) })
+				continue
+			}
+			return nil, &spanError{offset: start, length: i + 1 - start,
+				msg: fmt.Sprintf("unsupported date directive '%%%c'", directive), hint: suggestDateDirective(directive)}
 		}
 	}
-	return b.String(), nil
+	flushLiteral()
+	return chunks, nil
 }
@@ -0,0 +1,76 @@
+package template
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// durationUnit is a unit selectable on duration tokens, e.g. {delta:ms}.
+type durationUnit struct {
+	suffix string
+	size   time.Duration
+	// precision is used when the modifier does not specify one.
+	precision int
+}
+
+// durationUnits is ordered so multi-letter suffixes are matched before "s".
+var durationUnits = []durationUnit{
+	{suffix: "ns", size: time.Nanosecond, precision: 0},
+	{suffix: "us", size: time.Microsecond, precision: 0},
+	{suffix: "µs", size: time.Microsecond, precision: 0},
+	{suffix: "ms", size: time.Millisecond, precision: 0},
+	{suffix: "s", size: time.Second, precision: 1},
+	{suffix: "m", size: time.Minute, precision: 1},
+	{suffix: "h", size: time.Hour, precision: 1},
+}
+
+// splitDurationUnit recognises modifiers such as "ms" or ".2s", returning the unit
+// and the fmt prefix that precedes it.
+func splitDurationUnit(modifier string) (durationUnit, string, bool) {
+	for _, unit := range durationUnits {
+		if prefix, ok := strings.CutSuffix(modifier, unit.suffix); ok {
+			return unit, prefix, true
+		}
+	}
+	return durationUnit{}, "", false
+}
+
+// unitFormat builds the fmt string for a unit modifier prefix such as "", ".2" or "8.3".
+func unitFormat(prefix string, unit durationUnit) (string, error) {
+	if !strings.Contains(prefix, ".") {
+		prefix += fmt.Sprintf(".%d", unit.precision)
+	}
+	fmtStr, ok := numericFormat(prefix + "f")
+	if !ok {
+		return "", fmt.Errorf("expected [width][.precision] before '%s'", unit.suffix)
+	}
+	return fmtStr, nil
+}
+
+// formatClock renders d as HH:MM:SS.mmm; hours grow past 24 rather than wrapping.
+func formatClock(d time.Duration) string {
+	sign := ""
+	if d < 0 {
+		sign = "-"
+		d = -d
+	}
+	d = d.Round(time.Millisecond)
+	hours := d / time.Hour
+	minutes := d % time.Hour / time.Minute
+	seconds := d % time.Minute / time.Second
+	millis := d % time.Second / time.Millisecond
+	return fmt.Sprintf("%s%02d:%02d:%02d.%03d", sign, hours, minutes, seconds, millis)
+}
+
+// formatHuman renders d compactly, e.g. 1m2.3s or 250ms, rounding to a tenth of a
+// second once d reaches one second.
+func formatHuman(d time.Duration) string {
+	switch abs := d.Abs(); {
+	case abs >= time.Second:
+		d = d.Round(100 * time.Millisecond)
+	case abs >= time.Millisecond:
+		d = d.Round(time.Millisecond)
+	}
+	return d.String()
+}
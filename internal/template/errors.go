@@ -0,0 +1,145 @@
+package template
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// ParseError reports a template that failed to parse, locating the problem in
+// the template source so callers can point at it.
+type ParseError struct {
+	// Template is the source that failed to parse.
+	Template string
+	// Offset and Length are the byte span of the problem within Template.
+	Offset int
+	Length int
+	// Line and Column give the 1-based position of Offset, counting characters.
+	Line   int
+	Column int
+	// Message describes the problem and Suggestion, when set, is a likely fix
+	// such as the token name the user probably meant.
+	Message    string
+	Suggestion string
+}
+
+func (e *ParseError) Error() string {
+	var b strings.Builder
+	b.WriteString(e.Message)
+	if e.Line > 1 {
+		fmt.Fprintf(&b, " at line %d, column %d", e.Line, e.Column)
+	} else {
+		fmt.Fprintf(&b, " at column %d", e.Column)
+	}
+	if e.Suggestion != "" {
+		fmt.Fprintf(&b, " (did you mean '%s'?)", e.Suggestion)
+	}
+	return b.String()
+}
+
+// Excerpt returns the offending template line with the problem underlined by
+// carets, each line indented by two spaces:
+//
+//	{elasped:.1f}s {}
+//	 ^^^^^^^
+func (e *ParseError) Excerpt() string {
+	lineStart := strings.LastIndexByte(e.Template[:e.Offset], '\n') + 1
+	lineEnd := len(e.Template)
+	if idx := strings.IndexByte(e.Template[e.Offset:], '\n'); idx != -1 {
+		lineEnd = e.Offset + idx
+	}
+	line := e.Template[lineStart:lineEnd]
+
+	// Keep tabs so the carets line up with the excerpt in a terminal.
+	var pad strings.Builder
+	for _, r := range e.Template[lineStart:e.Offset] {
+		if r == '\t' {
+			pad.WriteRune('\t')
+		} else {
+			pad.WriteByte(' ')
+		}
+	}
+	spanEnd := min(e.Offset+e.Length, lineEnd)
+	carets := max(utf8.RuneCountInString(e.Template[e.Offset:spanEnd]), 1)
+	return "  " + line + "\n  " + pad.String() + strings.Repeat("^", carets) + "\n"
+}
+
+// newParseError locates a problem spanning [offset, offset+length) in input.
+func newParseError(input string, offset, length int, msg, suggestion string) *ParseError {
+	offset = min(max(offset, 0), len(input))
+	before := input[:offset]
+	lineStart := strings.LastIndexByte(before, '\n') + 1
+	return &ParseError{
+		Template:   input,
+		Offset:     offset,
+		Length:     length,
+		Line:       strings.Count(before, "\n") + 1,
+		Column:     utf8.RuneCountInString(before[lineStart:]) + 1,
+		Message:    msg,
+		Suggestion: suggestion,
+	}
+}
+
+// spanError is an error located within a piece of a token, such as a name,
+// date directive or condition. offset is relative to that piece until
+// shiftSpan moves it into token coordinates.
+type spanError struct {
+	offset int
+	length int
+	msg    string
+	hint   string
+}
+
+func (e *spanError) Error() string {
+	return e.msg
+}
+
+// shiftSpan moves the span carried by err, if any, by the given number of bytes.
+func shiftSpan(err error, by int) error {
+	var span *spanError
+	if errors.As(err, &span) {
+		span.offset += by
+	}
+	return err
+}
+
+// suggest returns the candidate closest to name, or "" when none is close
+// enough to be a likely typo.
+func suggest(name string, candidates []string) string {
+	best, bestDist := "", 3
+	for _, candidate := range candidates {
+		dist := editDistance(name, candidate)
+		if dist < bestDist && dist < utf8.RuneCountInString(name) {
+			best, bestDist = candidate, dist
+		}
+	}
+	return best
+}
+
+// editDistance is the optimal string alignment distance between a and b:
+// insertions, deletions, substitutions and adjacent transpositions each cost 1.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	rows := make([][]int, len(ra)+1)
+	for i := range rows {
+		rows[i] = make([]int, len(rb)+1)
+		rows[i][0] = i
+	}
+	for j := range rows[0] {
+		rows[0][j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			rows[i][j] = min(rows[i-1][j]+1, rows[i][j-1]+1, rows[i-1][j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				rows[i][j] = min(rows[i][j], rows[i-2][j-2]+1)
+			}
+		}
+	}
+	return rows[len(ra)][len(rb)]
+}
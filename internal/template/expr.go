@@ -0,0 +1,525 @@
+package template
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// exprType is the static type of an expression, checked when the template is parsed.
+type exprType int
+
+const (
+	typeNumber exprType = iota
+	typeString
+	typeBool
+	// typeJSON values come from {json:...} paths and are coerced to the type
+	// they are compared with when the template renders.
+	typeJSON
+)
+
+func (t exprType) String() string {
+	switch t {
+	case typeNumber:
+		return "number"
+	case typeString:
+		return "string"
+	case typeBool:
+		return "boolean"
+	default:
+		return "json value"
+	}
+}
+
+// exprNode is a type-checked expression. Exactly one of num, str or cond is set,
+// matching typ (typeJSON uses str).
+type exprNode struct {
+	typ  exprType
+	num  func(StampState) float64
+	str  func(StampState) string
+	cond func(StampState) bool
+	uses stateUse
+	// text and pos locate the node's source, used in error messages.
+	text string
+	pos  int
+}
+
+// exprRefs are the names usable as operands in conditions.
+var exprRefs = map[string]exprNode{
+	"elapsed":    {typ: typeNumber, num: func(s StampState) float64 { return s.Elapsed.Seconds() }},
+	"delta":      {typ: typeNumber, uses: useDelta, num: func(s StampState) float64 { return s.Delta.Seconds() }},
+	"since":      {typ: typeNumber, num: func(s StampState) float64 { return s.Since.Seconds() }},
+	"prev_delta": {typ: typeNumber, num: func(s StampState) float64 { return s.Since.Seconds() }},
+	"idle":       {typ: typeNumber, num: func(s StampState) float64 { return s.Idle.Seconds() }},
+	"unix":       {typ: typeNumber, num: func(s StampState) float64 { return float64(s.Now.UnixNano()) / float64(time.Second) }},
+	"line":       {typ: typeNumber, num: func(s StampState) float64 { return float64(s.Line) }},
+	"seq":        {typ: typeNumber, uses: useSeq, num: func(s StampState) float64 { return float64(s.Seq) }},
+	"text":       {typ: typeString, str: func(s StampState) string { return s.Raw }},
+}
+
+// parseCondition parses and type-checks the expression of an {if ...} block.
+// Strings and JSON values are true when non-empty.
+func parseCondition(src string) (exprNode, error) {
+	p := exprParser{src: src}
+	p.next()
+	node, err := p.parseOr()
+	if err != nil {
+		return exprNode{}, err
+	}
+	if p.tok.err != nil {
+		return exprNode{}, p.tok.err
+	}
+	if p.tok.kind != tokEOF {
+		return exprNode{}, p.errorf(p.tok.pos, "unexpected '%s' after expression", p.tok.text)
+	}
+	return p.toBool(node)
+}
+
+type exprTokenKind int
+
+const (
+	tokEOF exprTokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokOp
+	tokLParen
+	tokRParen
+)
+
+type exprToken struct {
+	kind exprTokenKind
+	text string
+	pos  int
+	num  float64
+	str  string
+	err  error
+}
+
+type exprParser struct {
+	src string
+	pos int
+	tok exprToken
+}
+
+func (p *exprParser) errorf(pos int, format string, args ...any) error {
+	return &spanError{offset: pos, msg: fmt.Sprintf(format, args...)}
+}
+
+var exprOps = []string{"&&", "||", "==", "!=", "<=", ">=", "=~", "!~", "<", ">", "!"}
+
+// next advances to the following token.
+func (p *exprParser) next() {
+	for p.pos < len(p.src) && p.src[p.pos] == ' ' {
+		p.pos++
+	}
+	start := p.pos
+	if p.pos >= len(p.src) {
+		p.tok = exprToken{kind: tokEOF, text: "end of condition", pos: start}
+		return
+	}
+	ch := p.src[p.pos]
+	switch {
+	case ch == '(':
+		p.pos++
+		p.tok = exprToken{kind: tokLParen, text: "(", pos: start}
+	case ch == ')':
+		p.pos++
+		p.tok = exprToken{kind: tokRParen, text: ")", pos: start}
+	case ch == '"':
+		p.lexString(start)
+	case ch >= '0' && ch <= '9' || ch == '.':
+		p.lexNumber(start)
+	case ch == '_' || unicode.IsLetter(rune(ch)):
+		p.lexIdent(start)
+	default:
+		for _, op := range exprOps {
+			if strings.HasPrefix(p.src[p.pos:], op) {
+				p.pos += len(op)
+				p.tok = exprToken{kind: tokOp, text: op, pos: start}
+				return
+			}
+		}
+		p.pos++
+		msg := fmt.Sprintf("unexpected character '%c' in condition", ch)
+		if ch == '=' {
+			msg = "unexpected '=' in condition; use '==' to compare"
+		}
+		p.tok = exprToken{kind: tokOp, text: string(ch), pos: start, err: &spanError{offset: start, length: 1, msg: msg}}
+	}
+}
+
+func (p *exprParser) lexString(start int) {
+	i := p.pos + 1
+	for i < len(p.src) && p.src[i] != '"' {
+		if p.src[i] == '\\' {
+			i++
+		}
+		i++
+	}
+	if i >= len(p.src) {
+		p.pos = len(p.src)
+		p.tok = exprToken{kind: tokString, text: p.src[start:], pos: start,
+			err: p.errorf(start, "unterminated string in condition")}
+		return
+	}
+	p.pos = i + 1
+	text := p.src[start:p.pos]
+	value, err := strconv.Unquote(text)
+	p.tok = exprToken{kind: tokString, text: text, pos: start, str: value}
+	if err != nil {
+		p.tok.err = p.errorf(start, "invalid string %s in condition", text)
+	}
+}
+
+// lexNumber reads a number with an optional duration unit (2s, 500ms, 1.5m),
+// converting durations to seconds to match the duration tokens.
+func (p *exprParser) lexNumber(start int) {
+	for p.pos < len(p.src) && (p.src[p.pos] >= '0' && p.src[p.pos] <= '9' || p.src[p.pos] == '.') {
+		p.pos++
+	}
+	digitsEnd := p.pos
+	for p.pos < len(p.src) && unicode.IsLetter(rune(p.src[p.pos])) {
+		p.pos++
+	}
+	text := p.src[start:p.pos]
+	p.tok = exprToken{kind: tokNumber, text: text, pos: start}
+	if digitsEnd == p.pos {
+		value, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			p.tok.err = p.errorf(start, "invalid number '%s' in condition", text)
+		}
+		p.tok.num = value
+		return
+	}
+	d, err := time.ParseDuration(text)
+	if err != nil {
+		p.tok.err = p.errorf(start, "invalid duration '%s' in condition (use units like 500ms, 2s, 1m)", text)
+	}
+	p.tok.num = d.Seconds()
+}
+
+// lexIdent reads a name, including the argument of field:NAME and json:path.
+func (p *exprParser) lexIdent(start int) {
+	for p.pos < len(p.src) && (p.src[p.pos] == '_' || unicode.IsLetter(rune(p.src[p.pos])) || unicode.IsDigit(rune(p.src[p.pos]))) {
+		p.pos++
+	}
+	if p.pos < len(p.src) && p.src[p.pos] == ':' {
+		p.pos++
+		for p.pos < len(p.src) && !strings.ContainsRune(" ()&|!=<>~\"", rune(p.src[p.pos])) {
+			p.pos++
+		}
+	}
+	p.tok = exprToken{kind: tokIdent, text: p.src[start:p.pos], pos: start}
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return exprNode{}, err
+	}
+	for p.tok.kind == tokOp && p.tok.text == "||" {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return exprNode{}, err
+		}
+		l, r, err := p.boolOperands(left, right)
+		if err != nil {
+			return exprNode{}, err
+		}
+		left = exprNode{typ: typeBool, uses: left.uses | right.uses, text: left.text + " || " + right.text, pos: left.pos,
+			cond: func(s StampState) bool { return l.cond(s) || r.cond(s) }}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return exprNode{}, err
+	}
+	for p.tok.kind == tokOp && p.tok.text == "&&" {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return exprNode{}, err
+		}
+		l, r, err := p.boolOperands(left, right)
+		if err != nil {
+			return exprNode{}, err
+		}
+		left = exprNode{typ: typeBool, uses: left.uses | right.uses, text: left.text + " && " + right.text, pos: left.pos,
+			cond: func(s StampState) bool { return l.cond(s) && r.cond(s) }}
+	}
+	return left, nil
+}
+
+func (p *exprParser) boolOperands(left, right exprNode) (exprNode, exprNode, error) {
+	l, err := p.toBool(left)
+	if err != nil {
+		return exprNode{}, exprNode{}, err
+	}
+	r, err := p.toBool(right)
+	if err != nil {
+		return exprNode{}, exprNode{}, err
+	}
+	return l, r, nil
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.tok.kind == tokOp && p.tok.text == "!" {
+		bang := p.tok.pos
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return exprNode{}, err
+		}
+		inner, err := p.toBool(operand)
+		if err != nil {
+			return exprNode{}, err
+		}
+		return exprNode{typ: typeBool, uses: inner.uses, text: "!" + inner.text, pos: bang,
+			cond: func(s StampState) bool { return !inner.cond(s) }}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return exprNode{}, err
+	}
+	if p.tok.kind != tokOp {
+		return left, nil
+	}
+	op := p.tok
+	switch op.text {
+	case "==", "!=", "<", "<=", ">", ">=":
+	case "=~", "!~":
+		return p.parseMatch(left, op)
+	default:
+		return left, nil
+	}
+	p.next()
+	right, err := p.parseOperand()
+	if err != nil {
+		return exprNode{}, err
+	}
+	return compare(left, right, op, p)
+}
+
+// parseMatch handles `operand =~ "regex"`; the pattern must be a string literal
+// so it can be compiled once at parse time.
+func (p *exprParser) parseMatch(left exprNode, op exprToken) (exprNode, error) {
+	p.next()
+	if p.tok.err != nil {
+		return exprNode{}, p.tok.err
+	}
+	if p.tok.kind != tokString {
+		return exprNode{}, p.errorf(p.tok.pos, "'%s' needs a quoted regular expression, got '%s'", op.text, p.tok.text)
+	}
+	pattern := p.tok
+	re, err := regexp.Compile(pattern.str)
+	if err != nil {
+		return exprNode{}, p.errorf(pattern.pos, "invalid regular expression %s: %v", pattern.text, err)
+	}
+	p.next()
+	if left.typ == typeNumber || left.typ == typeBool {
+		return exprNode{}, p.errorf(op.pos, "cannot match %s '%s' against a regular expression", left.typ, left.text)
+	}
+	negate := op.text == "!~"
+	str := left.str
+	return exprNode{typ: typeBool, uses: left.uses, text: left.text + " " + op.text + " " + pattern.text, pos: left.pos,
+		cond: func(s StampState) bool { return re.MatchString(str(s)) != negate }}, nil
+}
+
+func (p *exprParser) parseOperand() (exprNode, error) {
+	tok := p.tok
+	if tok.err != nil {
+		return exprNode{}, tok.err
+	}
+	switch tok.kind {
+	case tokNumber:
+		p.next()
+		value := tok.num
+		return exprNode{typ: typeNumber, text: tok.text, pos: tok.pos, num: func(StampState) float64 { return value }}, nil
+	case tokString:
+		p.next()
+		value := tok.str
+		return exprNode{typ: typeString, text: tok.text, pos: tok.pos, str: func(StampState) string { return value }}, nil
+	case tokIdent:
+		p.next()
+		return p.resolveRef(tok)
+	case tokLParen:
+		p.next()
+		inner, err := p.parseOr()
+		if err != nil {
+			return exprNode{}, err
+		}
+		if p.tok.kind != tokRParen {
+			return exprNode{}, p.errorf(p.tok.pos, "expected ')' but found '%s'", p.tok.text)
+		}
+		p.next()
+		inner.text = "(" + inner.text + ")"
+		inner.pos = tok.pos
+		return inner, nil
+	default:
+		return exprNode{}, p.errorf(tok.pos, "expected a value but found '%s'", tok.text)
+	}
+}
+
+func (p *exprParser) resolveRef(tok exprToken) (exprNode, error) {
+	name, arg, hasArg := strings.Cut(tok.text, ":")
+	switch name {
+	case "field":
+		if arg == "" {
+			return exprNode{}, p.errorf(tok.pos, "field needs a name, e.g. field:user")
+		}
+		return exprNode{typ: typeString, text: tok.text, pos: tok.pos, str: func(s StampState) string { return s.Fields[arg] }}, nil
+	case "json":
+		if arg == "" {
+			return exprNode{}, p.errorf(tok.pos, "json needs a path, e.g. json:level")
+		}
+		keys := strings.Split(arg, ".")
+		return exprNode{typ: typeJSON, uses: useJSON, text: tok.text, pos: tok.pos,
+			str: func(s StampState) string { return jsonString(lookupJSON(s.JSON, keys)) }}, nil
+	case "true", "false":
+		value := name == "true"
+		return exprNode{typ: typeBool, text: tok.text, pos: tok.pos, cond: func(StampState) bool { return value }}, nil
+	}
+	ref, ok := exprRefs[name]
+	if !ok || hasArg {
+		return exprNode{}, &spanError{offset: tok.pos, length: len(tok.text),
+			msg: fmt.Sprintf("unknown name '%s' in condition", tok.text), hint: suggest(name, conditionNames())}
+	}
+	ref.text = tok.text
+	ref.pos = tok.pos
+	return ref, nil
+}
+
+// conditionNames lists the names a condition may use, for suggestions.
+func conditionNames() []string {
+	names := []string{"field", "json", "true", "false"}
+	for name := range exprRefs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// toBool converts a node to a condition; strings and JSON values are true when
+// non-empty, while numbers must be compared explicitly.
+func (p *exprParser) toBool(node exprNode) (exprNode, error) {
+	switch node.typ {
+	case typeBool:
+		return node, nil
+	case typeString, typeJSON:
+		str := node.str
+		return exprNode{typ: typeBool, uses: node.uses, text: node.text, pos: node.pos,
+			cond: func(s StampState) bool { return str(s) != "" }}, nil
+	default:
+		return exprNode{}, p.errorf(node.pos, "condition '%s' is a number; compare it with a value, e.g. %s > 0", node.text, node.text)
+	}
+}
+
+// compare builds a comparison, checking that the operand types agree. JSON
+// values adopt the type of the other side; a JSON value that is not a number
+// (or boolean) makes numeric (or boolean) comparisons false.
+func compare(left, right exprNode, op exprToken, p *exprParser) (exprNode, error) {
+	lt, rt := left.typ, right.typ
+	if lt == typeJSON {
+		lt = rt
+	}
+	if rt == typeJSON {
+		rt = lt
+	}
+	if lt != rt {
+		return exprNode{}, p.errorf(op.pos, "cannot compare %s '%s' with %s '%s'", left.typ, left.text, right.typ, right.text)
+	}
+	uses := left.uses | right.uses
+	text := left.text + " " + op.text + " " + right.text
+	pos := left.pos
+
+	switch lt {
+	case typeNumber:
+		l, r := numeric(left), numeric(right)
+		cmp := numberComparisons[op.text]
+		return exprNode{typ: typeBool, uses: uses, text: text, pos: pos, cond: func(s StampState) bool {
+			a, aok := l(s)
+			b, bok := r(s)
+			return aok && bok && cmp(a, b)
+		}}, nil
+	case typeBool:
+		if op.text != "==" && op.text != "!=" {
+			return exprNode{}, p.errorf(op.pos, "'%s' does not apply to booleans", op.text)
+		}
+		l, r := boolean(left), boolean(right)
+		equal := op.text == "=="
+		return exprNode{typ: typeBool, uses: uses, text: text, pos: pos, cond: func(s StampState) bool {
+			a, aok := l(s)
+			b, bok := r(s)
+			return aok && bok && (a == b) == equal
+		}}, nil
+	default:
+		l, r := left.str, right.str
+		cmp := stringComparisons[op.text]
+		return exprNode{typ: typeBool, uses: uses, text: text, pos: pos, cond: func(s StampState) bool {
+			return cmp(l(s), r(s))
+		}}, nil
+	}
+}
+
+// numeric returns a number getter for node, parsing JSON values at render time.
+func numeric(node exprNode) func(StampState) (float64, bool) {
+	if node.typ == typeNumber {
+		num := node.num
+		return func(s StampState) (float64, bool) { return num(s), true }
+	}
+	str := node.str
+	return func(s StampState) (float64, bool) {
+		value, err := strconv.ParseFloat(str(s), 64)
+		return value, err == nil
+	}
+}
+
+// boolean returns a bool getter for node. JSON values count only when they are
+// true or false, either as JSON booleans or as those strings.
+func boolean(node exprNode) func(StampState) (bool, bool) {
+	if node.typ == typeBool {
+		cond := node.cond
+		return func(s StampState) (bool, bool) { return cond(s), true }
+	}
+	str := node.str
+	return func(s StampState) (bool, bool) {
+		switch str(s) {
+		case "true":
+			return true, true
+		case "false":
+			return false, true
+		}
+		return false, false
+	}
+}
+
+var numberComparisons = map[string]func(a, b float64) bool{
+	"==": func(a, b float64) bool { return a == b },
+	"!=": func(a, b float64) bool { return a != b },
+	"<":  func(a, b float64) bool { return a < b },
+	"<=": func(a, b float64) bool { return a <= b },
+	">":  func(a, b float64) bool { return a > b },
+	">=": func(a, b float64) bool { return a >= b },
+}
+
+var stringComparisons = map[string]func(a, b string) bool{
+	"==": func(a, b string) bool { return a == b },
+	"!=": func(a, b string) bool { return a != b },
+	"<":  func(a, b string) bool { return a < b },
+	"<=": func(a, b string) bool { return a <= b },
+	">":  func(a, b string) bool { return a > b },
+	">=": func(a, b string) bool { return a >= b },
+}
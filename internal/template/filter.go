@@ -0,0 +1,109 @@
+package template
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// filter transforms the string a token renders, e.g. {|upper}.
+type filter func(string) string
+
+// filterFactory builds a filter from its optional argument ({|truncate:80}).
+type filterFactory func(arg string) (filter, error)
+
+// filters is the registry of pipe filters available after any token.
+var filters = map[string]filterFactory{
+	"upper":      noArg("upper", strings.ToUpper),
+	"lower":      noArg("lower", strings.ToLower),
+	"trim":       noArg("trim", strings.TrimSpace),
+	"quote":      noArg("quote", strconv.Quote),
+	"strip_ansi": noArg("strip_ansi", stripANSI),
+	"truncate": func(arg string) (filter, error) {
+		n, err := filterCount("truncate", arg, 0)
+		if err != nil {
+			return nil, err
+		}
+		return func(value string) string { return truncateRunes(value, n) }, nil
+	},
+	"hash": func(arg string) (filter, error) {
+		n, err := filterCount("hash", arg, defaultHashLength)
+		if err != nil {
+			return nil, err
+		}
+		if n > sha256.Size*2 {
+			return nil, fmt.Errorf("hash length %d exceeds %d hex digits", n, sha256.Size*2)
+		}
+		return func(value string) string { return hashHex(value, n) }, nil
+	},
+}
+
+// defaultHashLength is the number of hex digits {|hash} keeps.
+const defaultHashLength = 8
+
+// parseFilter builds the filter for a pipe stage such as "truncate:80". Errors
+// are located within the stage.
+func parseFilter(stage string) (filter, error) {
+	name, arg, _ := strings.Cut(stage, ":")
+	name = strings.TrimSpace(name)
+	factory, ok := filters[name]
+	if !ok {
+		return nil, &spanError{length: len(name), hint: suggest(name, filterNames()),
+			msg: fmt.Sprintf("unknown filter '%s' (available: %s)", name, strings.Join(filterNames(), ", "))}
+	}
+	fn, err := factory(strings.TrimSpace(arg))
+	if err != nil {
+		return nil, &spanError{length: len(stage), msg: err.Error()}
+	}
+	return fn, nil
+}
+
+func filterNames() []string {
+	names := make([]string, 0, len(filters))
+	for name := range filters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func noArg(name string, fn func(string) string) filterFactory {
+	return func(arg string) (filter, error) {
+		if arg != "" {
+			return nil, fmt.Errorf("filter '%s' does not take an argument", name)
+		}
+		return fn, nil
+	}
+}
+
+// filterCount parses a positive count argument; fallback applies when the
+// argument is omitted, and zero means the argument is required.
+func filterCount(name, arg string, fallback int) (int, error) {
+	if arg == "" {
+		if fallback == 0 {
+			return 0, fmt.Errorf("filter '%s' needs a length, e.g. %s:8", name, name)
+		}
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(arg)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("filter '%s' needs a positive length, got '%s'", name, arg)
+	}
+	return n, nil
+}
+
+// hashHex returns the first n hex digits of the SHA-256 digest of value.
+func hashHex(value string, n int) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])[:n]
+}
+
+var ansiPattern = regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]`)
+
+func stripANSI(value string) string {
+	return ansiPattern.ReplaceAllString(value, "")
+}
@@ -0,0 +1,172 @@
+package template
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// formatSpec is the width and alignment mini-language shared by every token:
+//
+//	[[fill]align][width][.precision]
+//
+// align is '<' (left), '>' (right) or '^' (centre); fill defaults to a space.
+// A width written with a leading zero (e.g. 06) pads with zeros on the left.
+// precision truncates the value to that many characters. The zero value leaves
+// values untouched.
+type formatSpec struct {
+	fill         rune
+	align        byte
+	width        int
+	precision    int
+	hasPrecision bool
+}
+
+// maxFormatWidth bounds spec widths so a typo cannot pad every line with
+// gigabytes of fill.
+const maxFormatWidth = 4096
+
+func isAlign(ch byte) bool {
+	return ch == '<' || ch == '>' || ch == '^'
+}
+
+// apply truncates and pads value according to the spec. Widths count runes.
+func (f formatSpec) apply(value string) string {
+	if f.hasPrecision {
+		value = truncateRunes(value, f.precision)
+	}
+	pad := f.width - utf8.RuneCountInString(value)
+	if pad <= 0 {
+		return value
+	}
+	fill := " "
+	if f.fill != 0 {
+		fill = string(f.fill)
+	}
+	switch f.align {
+	case '>':
+		return strings.Repeat(fill, pad) + value
+	case '^':
+		left := pad / 2
+		return strings.Repeat(fill, left) + value + strings.Repeat(fill, pad-left)
+	default:
+		return value + strings.Repeat(fill, pad)
+	}
+}
+
+// truncateRunes keeps at most n characters of value.
+func truncateRunes(value string, n int) string {
+	if utf8.RuneCountInString(value) <= n {
+		return value
+	}
+	return string([]rune(value)[:n])
+}
+
+// splitAlignSpec consumes a leading [[fill]align][width] from modifier when an
+// explicit align character is present, returning the spec and the remainder.
+// Tokens with their own modifiers (numeric formats, layouts) use this so that
+// {delta:>8.3f} pads to 8 and still formats with .3f.
+func splitAlignSpec(modifier string) (formatSpec, string, error) {
+	var spec formatSpec
+	rest := modifier
+	switch {
+	case len(rest) > 0 && isAlign(rest[0]):
+		spec.align = rest[0]
+		rest = rest[1:]
+	default:
+		fill, size := utf8.DecodeRuneInString(rest)
+		if size == 0 || size >= len(rest) || !isAlign(rest[size]) {
+			return formatSpec{}, modifier, nil
+		}
+		spec.fill = fill
+		spec.align = rest[size]
+		rest = rest[size+1:]
+	}
+	digits := 0
+	for digits < len(rest) && rest[digits] >= '0' && rest[digits] <= '9' {
+		digits++
+	}
+	if digits > 0 {
+		width, err := parseWidth(rest[:digits], modifier)
+		if err != nil {
+			return formatSpec{}, "", err
+		}
+		spec.width = width
+	}
+	return spec, rest[digits:], nil
+}
+
+// parseWidth reads the width digits of the spec modifier.
+func parseWidth(digits, modifier string) (int, error) {
+	width, err := strconv.Atoi(digits)
+	if err != nil || width > maxFormatWidth {
+		return 0, fmt.Errorf("invalid format spec '%s': width must be at most %d", modifier, maxFormatWidth)
+	}
+	return width, nil
+}
+
+// parseFormatSpec parses a complete spec for tokens without a modifier of their
+// own, such as {line:>6} or {:.120}. defaultAlign applies when none is given.
+func parseFormatSpec(modifier string, defaultAlign byte) (formatSpec, error) {
+	spec, rest, err := splitAlignSpec(modifier)
+	if err != nil {
+		return formatSpec{}, err
+	}
+	explicit := spec.align != 0
+	if !explicit {
+		spec.align = defaultAlign
+		digits := 0
+		for digits < len(rest) && rest[digits] >= '0' && rest[digits] <= '9' {
+			digits++
+		}
+		if digits > 0 {
+			if rest[0] == '0' && digits > 1 {
+				spec.fill = '0'
+				spec.align = '>'
+			}
+			if spec.width, err = parseWidth(rest[:digits], modifier); err != nil {
+				return formatSpec{}, err
+			}
+			rest = rest[digits:]
+		}
+	}
+	if after, ok := strings.CutPrefix(rest, "."); ok {
+		precision, err := strconv.Atoi(after)
+		if err != nil || precision < 0 {
+			return formatSpec{}, fmt.Errorf("invalid format spec '%s': precision must be a number", modifier)
+		}
+		spec.precision = precision
+		spec.hasPrecision = true
+		rest = ""
+	}
+	if rest != "" {
+		return formatSpec{}, fmt.Errorf("invalid format spec '%s' (want [[fill]align][width][.precision])", modifier)
+	}
+	return spec, nil
+}
+
+// numericFormat validates a printf-style float modifier such as ".3f" or
+// "+010.2e" - [flags][width][.precision]verb, with flags from "+- #0" and verb
+// one of e, E, f, F, g or G - and returns the fmt verb for it.
+func numericFormat(modifier string) (string, bool) {
+	i := 0
+	for i < len(modifier) && strings.IndexByte("+- #0", modifier[i]) != -1 {
+		i++
+	}
+	i = skipDigits(modifier, i)
+	if i < len(modifier) && modifier[i] == '.' {
+		i = skipDigits(modifier, i+1)
+	}
+	if i != len(modifier)-1 || strings.IndexByte("eEfFgG", modifier[i]) == -1 {
+		return "", false
+	}
+	return "%" + modifier, true
+}
+
+func skipDigits(s string, i int) int {
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	return i
+}
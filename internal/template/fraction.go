@@ -0,0 +1,143 @@
+package template
+
+import (
+	"strconv"
+	"strings"
+)
+
+// fractionDigits reads a sub-second precision: a unit (s, ms, us, µs, ns) or
+// a single digit giving the number of fractional-second digits.
+func fractionDigits(modifier string) (int, bool) {
+	switch modifier {
+	case "s":
+		return 0, true
+	case "ms":
+		return 3, true
+	case "us", "µs":
+		return 6, true
+	case "ns":
+		return 9, true
+	}
+	if len(modifier) == 1 && modifier[0] >= '0' && modifier[0] <= '9' {
+		return int(modifier[0] - '0'), true
+	}
+	return 0, false
+}
+
+// splitFractionSuffix separates a trailing precision marker from a {time}
+// layout: ":.N" for N digits, or ":ms", ":us" or ":ns". A bare ":N" is not a
+// marker, so layouts such as "15:04:05:1" keep their meaning. The marker also
+// only counts when the rest of the layout has a seconds field.
+func splitFractionSuffix(layout string) (string, int, bool) {
+	idx := strings.LastIndexByte(layout, ':')
+	if idx == -1 {
+		return layout, 0, false
+	}
+	marker := layout[idx+1:]
+	var digits int
+	if n, ok := strings.CutPrefix(marker, "."); ok && len(n) == 1 {
+		digits, ok = fractionDigits(n)
+		if !ok {
+			return layout, 0, false
+		}
+	} else if marker == "ms" || marker == "us" || marker == "µs" || marker == "ns" {
+		digits, _ = fractionDigits(marker)
+	} else {
+		return layout, 0, false
+	}
+	rest := layout[:idx]
+	if _, ok := withFraction(namedLayout(rest), digits); !ok {
+		return layout, 0, false
+	}
+	return rest, digits, true
+}
+
+// withFraction rewrites a Go or date(1)-style layout so the seconds field is
+// followed by exactly digits fractional digits, replacing any fraction already
+// there. It reports false when the layout has no seconds field.
+func withFraction(layout string, digits int) (string, bool) {
+	if strings.Contains(layout, "%") {
+		return dateLayoutWithFraction(layout, digits)
+	}
+	idx := strings.Index(layout, "05")
+	if idx == -1 {
+		return "", false
+	}
+	end := idx + len("05")
+	rest := layout[end:]
+	if len(rest) > 1 && (rest[0] == '.' || rest[0] == ',') && (rest[1] == '0' || rest[1] == '9') {
+		n := 1
+		for n < len(rest) && rest[n] == rest[1] {
+			n++
+		}
+		rest = rest[n:]
+	}
+	fraction := ""
+	if digits > 0 {
+		fraction = "." + strings.Repeat("0", digits)
+	}
+	return layout[:end] + fraction + rest, true
+}
+
+// dateLayoutWithFraction places %<digits>N after the first %S, expanding
+// composite directives such as %T so their seconds can be found. A fraction
+// directive (%N, %3N, %f, %6f) already following %S is replaced.
+func dateLayoutWithFraction(layout string, digits int) (string, bool) {
+	expanded := expandDateComposites(layout)
+	for i := 0; i+1 < len(expanded); i++ {
+		if expanded[i] != '%' {
+			continue
+		}
+		if expanded[i+1] != 'S' {
+			i++ // skip the directive, including %%
+			continue
+		}
+		end := i + 2
+		rest := strings.TrimPrefix(expanded[end:], ".")
+		if n := dateFractionLength(rest); n > 0 {
+			rest = rest[n:]
+		} else {
+			rest = expanded[end:]
+		}
+		fraction := ""
+		if digits > 0 {
+			fraction = ".%" + strconv.Itoa(digits) + "N"
+		}
+		return expanded[:end] + fraction + rest, true
+	}
+	return "", false
+}
+
+// dateFractionLength returns the length of a leading %N, %<d>N, %f or %<d>f.
+func dateFractionLength(s string) int {
+	if len(s) < 2 || s[0] != '%' {
+		return 0
+	}
+	n := 1
+	if s[n] >= '1' && s[n] <= '9' && len(s) > 2 {
+		n++
+	}
+	if s[n] == 'N' || s[n] == 'f' {
+		return n + 1
+	}
+	return 0
+}
+
+// expandDateComposites replaces composite directives (%T, %r, %c, ...) with
+// their expansions, leaving everything else untouched.
+func expandDateComposites(layout string) string {
+	var b strings.Builder
+	for i := 0; i < len(layout); i++ {
+		if layout[i] != '%' || i+1 >= len(layout) {
+			b.WriteByte(layout[i])
+			continue
+		}
+		if expansion, ok := compositeDirectives[layout[i+1]]; ok {
+			b.WriteString(expandDateComposites(expansion))
+		} else {
+			b.WriteString(layout[i : i+2])
+		}
+		i++
+	}
+	return b.String()
+}
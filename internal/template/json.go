@@ -0,0 +1,50 @@
+package template
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// lookupJSON walks a decoded JSON value along keys. Object members are selected
+// by name and array elements by index; missing paths yield nil.
+func lookupJSON(value any, keys []string) any {
+	for _, key := range keys {
+		switch v := value.(type) {
+		case map[string]any:
+			value = v[key]
+		case []any:
+			idx, err := strconv.Atoi(key)
+			if err != nil || idx < 0 || idx >= len(v) {
+				return nil
+			}
+			value = v[idx]
+		default:
+			return nil
+		}
+	}
+	return value
+}
+
+// jsonString renders a decoded JSON value for a template: strings without
+// quotes, numbers as written in the input (json.Number) or in their shortest
+// form, null as empty, and objects or arrays as compact JSON.
+func jsonString(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return ""
+		}
+		return string(encoded)
+	}
+}
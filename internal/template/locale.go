@@ -0,0 +1,149 @@
+package template
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Locale holds the month and weekday names and AM/PM markers that date(1)
+// directives (%a %A %b %B %h %p %P) render.
+type Locale struct {
+	Months      [12]string
+	ShortMonths [12]string
+	// Days and ShortDays start on Sunday, matching time.Weekday.
+	Days      [7]string
+	ShortDays [7]string
+	AM, PM    string
+}
+
+// locales are the built-in tables, keyed by language code. Languages without
+// their own AM/PM markers keep the English ones.
+var locales = map[string]Locale{
+	"en": {
+		Months:      [12]string{"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"},
+		ShortMonths: [12]string{"Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec"},
+		Days:        [7]string{"Sunday", "Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday"},
+		ShortDays:   [7]string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"},
+		AM:          "AM",
+		PM:          "PM",
+	},
+	"de": {
+		Months:      [12]string{"Januar", "Februar", "März", "April", "Mai", "Juni", "Juli", "August", "September", "Oktober", "November", "Dezember"},
+		ShortMonths: [12]string{"Jan", "Feb", "Mär", "Apr", "Mai", "Jun", "Jul", "Aug", "Sep", "Okt", "Nov", "Dez"},
+		Days:        [7]string{"Sonntag", "Montag", "Dienstag", "Mittwoch", "Donnerstag", "Freitag", "Samstag"},
+		ShortDays:   [7]string{"So", "Mo", "Di", "Mi", "Do", "Fr", "Sa"},
+		AM:          "AM",
+		PM:          "PM",
+	},
+	"fr": {
+		Months:      [12]string{"janvier", "février", "mars", "avril", "mai", "juin", "juillet", "août", "septembre", "octobre", "novembre", "décembre"},
+		ShortMonths: [12]string{"janv.", "févr.", "mars", "avril", "mai", "juin", "juil.", "août", "sept.", "oct.", "nov.", "déc."},
+		Days:        [7]string{"dimanche", "lundi", "mardi", "mercredi", "jeudi", "vendredi", "samedi"},
+		ShortDays:   [7]string{"dim.", "lun.", "mar.", "mer.", "jeu.", "ven.", "sam."},
+		AM:          "AM",
+		PM:          "PM",
+	},
+	"es": {
+		Months:      [12]string{"enero", "febrero", "marzo", "abril", "mayo", "junio", "julio", "agosto", "septiembre", "octubre", "noviembre", "diciembre"},
+		ShortMonths: [12]string{"ene", "feb", "mar", "abr", "may", "jun", "jul", "ago", "sep", "oct", "nov", "dic"},
+		Days:        [7]string{"domingo", "lunes", "martes", "miércoles", "jueves", "viernes", "sábado"},
+		ShortDays:   [7]string{"dom", "lun", "mar", "mié", "jue", "vie", "sáb"},
+		AM:          "a. m.",
+		PM:          "p. m.",
+	},
+	"it": {
+		Months:      [12]string{"gennaio", "febbraio", "marzo", "aprile", "maggio", "giugno", "luglio", "agosto", "settembre", "ottobre", "novembre", "dicembre"},
+		ShortMonths: [12]string{"gen", "feb", "mar", "apr", "mag", "giu", "lug", "ago", "set", "ott", "nov", "dic"},
+		Days:        [7]string{"domenica", "lunedì", "martedì", "mercoledì", "giovedì", "venerdì", "sabato"},
+		ShortDays:   [7]string{"dom", "lun", "mar", "mer", "gio", "ven", "sab"},
+		AM:          "AM",
+		PM:          "PM",
+	},
+	"pt": {
+		Months:      [12]string{"janeiro", "fevereiro", "março", "abril", "maio", "junho", "julho", "agosto", "setembro", "outubro", "novembro", "dezembro"},
+		ShortMonths: [12]string{"jan", "fev", "mar", "abr", "mai", "jun", "jul", "ago", "set", "out", "nov", "dez"},
+		Days:        [7]string{"domingo", "segunda-feira", "terça-feira", "quarta-feira", "quinta-feira", "sexta-feira", "sábado"},
+		ShortDays:   [7]string{"dom", "seg", "ter", "qua", "qui", "sex", "sáb"},
+		AM:          "AM",
+		PM:          "PM",
+	},
+	"nl": {
+		Months:      [12]string{"januari", "februari", "maart", "april", "mei", "juni", "juli", "augustus", "september", "oktober", "november", "december"},
+		ShortMonths: [12]string{"jan", "feb", "mrt", "apr", "mei", "jun", "jul", "aug", "sep", "okt", "nov", "dec"},
+		Days:        [7]string{"zondag", "maandag", "dinsdag", "woensdag", "donderdag", "vrijdag", "zaterdag"},
+		ShortDays:   [7]string{"zo", "ma", "di", "wo", "do", "vr", "za"},
+		AM:          "AM",
+		PM:          "PM",
+	},
+	"ja": {
+		Months:      [12]string{"1月", "2月", "3月", "4月", "5月", "6月", "7月", "8月", "9月", "10月", "11月", "12月"},
+		ShortMonths: [12]string{"1月", "2月", "3月", "4月", "5月", "6月", "7月", "8月", "9月", "10月", "11月", "12月"},
+		Days:        [7]string{"日曜日", "月曜日", "火曜日", "水曜日", "木曜日", "金曜日", "土曜日"},
+		ShortDays:   [7]string{"日", "月", "火", "水", "木", "金", "土"},
+		AM:          "午前",
+		PM:          "午後",
+	},
+	"zh": {
+		Months:      [12]string{"一月", "二月", "三月", "四月", "五月", "六月", "七月", "八月", "九月", "十月", "十一月", "十二月"},
+		ShortMonths: [12]string{"1月", "2月", "3月", "4月", "5月", "6月", "7月", "8月", "9月", "10月", "11月", "12月"},
+		Days:        [7]string{"星期日", "星期一", "星期二", "星期三", "星期四", "星期五", "星期六"},
+		ShortDays:   [7]string{"日", "一", "二", "三", "四", "五", "六"},
+		AM:          "上午",
+		PM:          "下午",
+	},
+	"ko": {
+		Months:      [12]string{"1월", "2월", "3월", "4월", "5월", "6월", "7월", "8월", "9월", "10월", "11월", "12월"},
+		ShortMonths: [12]string{"1월", "2월", "3월", "4월", "5월", "6월", "7월", "8월", "9월", "10월", "11월", "12월"},
+		Days:        [7]string{"일요일", "월요일", "화요일", "수요일", "목요일", "금요일", "토요일"},
+		ShortDays:   [7]string{"일", "월", "화", "수", "목", "금", "토"},
+		AM:          "오전",
+		PM:          "오후",
+	},
+}
+
+// LookupLocale finds the built-in locale for a name such as "de", "de_DE",
+// "ja-JP" or "fr_FR.UTF-8"; only the language part is used. "C" and "POSIX"
+// select English.
+func LookupLocale(name string) (*Locale, error) {
+	lang := strings.ToLower(strings.TrimSpace(name))
+	if i := strings.IndexAny(lang, "_-.@"); i != -1 {
+		lang = lang[:i]
+	}
+	if lang == "c" || lang == "posix" {
+		lang = "en"
+	}
+	locale, ok := locales[lang]
+	if !ok {
+		return nil, fmt.Errorf("unknown locale '%s' (available: %s)", name, strings.Join(localeNames(), ", "))
+	}
+	return &locale, nil
+}
+
+func localeNames() []string {
+	names := make([]string, 0, len(locales))
+	for name := range locales {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// localizedDirectives render names from the active locale.
+var localizedDirectives = map[byte]func(l *Locale, t time.Time) string{
+	'b': func(l *Locale, t time.Time) string { return l.ShortMonths[t.Month()-1] },
+	'h': func(l *Locale, t time.Time) string { return l.ShortMonths[t.Month()-1] },
+	'B': func(l *Locale, t time.Time) string { return l.Months[t.Month()-1] },
+	'a': func(l *Locale, t time.Time) string { return l.ShortDays[t.Weekday()] },
+	'A': func(l *Locale, t time.Time) string { return l.Days[t.Weekday()] },
+	'p': func(l *Locale, t time.Time) string { return l.meridiem(t) },
+	'P': func(l *Locale, t time.Time) string { return strings.ToLower(l.meridiem(t)) },
+}
+
+func (l *Locale) meridiem(t time.Time) string {
+	if t.Hour() < 12 {
+		return l.AM
+	}
+	return l.PM
+}
@@ -0,0 +1,31 @@
+package template
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// processValues resolves the {host}, {pid} and {user} tokens. They are looked
+// up once per token when the template is parsed, so rendering just copies a
+// string.
+var processValues = map[string]func() string{
+	"host": func() string {
+		host, _ := os.Hostname()
+		return host
+	},
+	"pid": func() string {
+		return strconv.Itoa(os.Getpid())
+	},
+	"user": func() string {
+		if current, err := user.Current(); err == nil {
+			return current.Username
+		}
+		return os.Getenv("USER")
+	},
+}
+
+// constantToken renders a value fixed at parse time.
+func constantToken(value string, spec formatSpec) tokenSegment {
+	return tokenSegment{eval: func(StampState) string { return value }, spec: spec}
+}
@@ -1,30 +1,115 @@
 package template
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 // StampState carries the data needed to render a template instance.
 type StampState struct {
-	Now      time.Time
-	Delta    time.Duration
+	Now   time.Time
+	Delta time.Duration
+	// Since is the time since the previous line; zero for the first line.
+	Since    time.Duration
 	Elapsed  time.Duration
+	Idle     time.Duration
 	Line     int
 	LineText string
+	// Raw is the line as read, without its newline, for {len}, {hash} and the
+	// text condition. Unlike LineText it is also set in JSONL mode.
+	Raw string
+	// Offset is the byte offset of the line in the input stream.
+	Offset int64
+	// Fields holds values captured from the line by --extract patterns.
+	Fields map[string]string
+	// JSON is the decoded line for {json:...} tokens; only filled when the
+	// template NeedsJSON. JSONLine reports whether the line decoded at all,
+	// since a JSON null leaves JSON nil too.
+	JSON     any
+	JSONLine bool
+	// Timers holds the time since each --timer stopwatch last restarted.
+	Timers map[string]time.Duration
+	// Seq numbers lines across runs for {seq}; only filled when the template
+	// NeedsSeq.
+	Seq int64
 }
 
 // Template renders brace-based stamp expressions.
 type Template struct {
-	segments           []segment
+	segments []segment
+	// hasLinePlaceholder is set when {} appears outside any {if} block and so
+	// is always rendered; branchLine when it only appears inside one.
 	hasLinePlaceholder bool
+	branchLine         bool
+	uses               stateUse
+}
+
+// stateUse records which optional parts of StampState a template reads, so
+// callers only compute what is rendered.
+type stateUse uint8
+
+const (
+	useJSON stateUse = 1 << iota
+	useSeq
+	useDelta
+)
+
+// NeedsJSON reports whether the template reads StampState.JSON, so callers can
+// skip decoding lines when it does not.
+func (t Template) NeedsJSON() bool {
+	return t.uses&useJSON != 0
+}
+
+// NeedsLookahead reports whether the template renders {delta}, the time until
+// the next line. Only then must a line be held back until its successor arrives.
+func (t Template) NeedsLookahead() bool {
+	return t.uses&useDelta != 0
+}
+
+// NeedsSeq reports whether the template renders {seq}, so callers only load and
+// persist the cross-run counter when it is used.
+func (t Template) NeedsSeq() bool {
+	return t.uses&useSeq != 0
+}
+
+// Config carries parse-time settings that apply to every token in a template.
+type Config struct {
+	// Color enables ANSI styling: {color:...}/{reset} emit escape sequences and
+	// {delta} is highlighted once it crosses WarnDelta or CritDelta.
+	Color bool
+	// WarnDelta and CritDelta are the {delta} thresholds rendered in yellow and
+	// red respectively. Zero disables a threshold.
+	WarnDelta time.Duration
+	CritDelta time.Duration
+	// Location is the default zone for {time} and {iso}; nil keeps the zone of
+	// the stamped time. A token-level @Zone modifier overrides it.
+	Location *time.Location
+	// RunID identifies this invocation for {run_id}.
+	RunID string
+	// Epoch is the reference time for {since_epoch}; zero leaves it unset.
+	Epoch time.Time
+	// Timers names the stopwatches {timer:NAME} may refer to.
+	Timers []string
+	// Locale supplies the month and weekday names and AM/PM markers of date(1)
+	// directives in {time}; nil means English.
+	Locale *Locale
 }
 
 // Parse builds a Template from the provided brace expression.
 func Parse(input string) (Template, error) {
-	p := parser{input: input}
+	return ParseWithConfig(input, Config{})
+}
+
+// ParseWithConfig builds a Template from the provided brace expression using cfg.
+func ParseWithConfig(input string, cfg Config) (Template, error) {
+	p := parser{input: input, cfg: cfg}
 	tpl, err := p.parse()
 	if err != nil {
 		return Template{}, err
@@ -39,7 +124,12 @@ func (t Template) Render(state StampState) string {
 		seg.append(&b, state)
 	}
 
-	if !t.hasLinePlaceholder && state.LineText != "" {
+	// Templates that read JSON fields reformat JSON lines, so their raw text is
+	// only included where {} asks for it; other lines are still appended. A {}
+	// inside an {if} only counts when its branch was rendered.
+	rendered := t.hasLinePlaceholder || (t.branchLine && rendersLine(t.segments, state))
+	reformatted := t.NeedsJSON() && state.JSONLine
+	if !rendered && !reformatted && state.LineText != "" {
 		if b.Len() > 0 {
 			b.WriteByte(' ')
 		}
@@ -61,37 +151,122 @@ func (l literalSegment) append(b *strings.Builder, _ StampState) {
 	b.WriteString(l.value)
 }
 
-type lineSegment struct{}
-
-func (lineSegment) append(b *strings.Builder, state StampState) {
-	b.WriteString(state.LineText)
-}
-
 type tokenSegment struct {
 	eval tokenEvaluator
+	// line marks the {} placeholder.
+	line bool
+	// uses marks tokens that read optional StampState fields such as JSON.
+	uses stateUse
+	// pipeline holds the |"default" and |filter stages, applied in order.
+	pipeline []filter
+	// spec pads or truncates the evaluated value before any styling is applied.
+	spec formatSpec
+	// style optionally returns an ANSI escape sequence to wrap the value in.
+	style func(StampState) string
 }
 
 func (t tokenSegment) append(b *strings.Builder, state StampState) {
-	b.WriteString(t.eval(state))
+	value := t.eval(state)
+	for _, stage := range t.pipeline {
+		value = stage(value)
+	}
+	value = t.spec.apply(value)
+	if t.style != nil {
+		if code := t.style(state); code != "" {
+			b.WriteString(code)
+			b.WriteString(value)
+			b.WriteString(ansiReset)
+			return
+		}
+	}
+	b.WriteString(value)
 }
 
 type tokenEvaluator func(StampState) string
 
+// rendersLine reports whether rendering segments for state includes the {}
+// placeholder, following only the {if} branches that are taken.
+func rendersLine(segments []segment, state StampState) bool {
+	for _, seg := range segments {
+		switch seg := seg.(type) {
+		case tokenSegment:
+			if seg.line {
+				return true
+			}
+		case ifSegment:
+			branch := seg.otherwise
+			if seg.cond(state) {
+				branch = seg.then
+			}
+			if rendersLine(branch, state) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ifSegment renders one of two branches depending on a condition evaluated per line.
+type ifSegment struct {
+	cond      func(StampState) bool
+	then      []segment
+	otherwise []segment
+}
+
+func (s ifSegment) append(b *strings.Builder, state StampState) {
+	branch := s.otherwise
+	if s.cond(state) {
+		branch = s.then
+	}
+	for _, seg := range branch {
+		seg.append(b, state)
+	}
+}
+
 type parser struct {
 	input string
 	pos   int
+	cfg   Config
+}
+
+// ifBlock is an {if ...} block that is still open while parsing. Segments are
+// collected into then until {else}, after which they go to otherwise.
+type ifBlock struct {
+	cond      exprNode
+	start     int
+	content   string
+	then      []segment
+	otherwise []segment
+	inElse    bool
+}
+
+func (blk *ifBlock) add(seg segment) {
+	if blk.inElse {
+		blk.otherwise = append(blk.otherwise, seg)
+		return
+	}
+	blk.then = append(blk.then, seg)
 }
 
 func (p *parser) parse() (Template, error) {
 	segments := []segment{}
+	var blocks []*ifBlock
 	var literal strings.Builder
-	hasLine := false
+	hasLine, branchLine := false, false
+	var uses stateUse
 
+	addSegment := func(seg segment) {
+		if len(blocks) > 0 {
+			blocks[len(blocks)-1].add(seg)
+			return
+		}
+		segments = append(segments, seg)
+	}
 	flushLiteral := func() {
 		if literal.Len() == 0 {
 			return
 		}
-		segments = append(segments, literalSegment{value: literal.String()})
+		addSegment(literalSegment{value: literal.String()})
 		literal.Reset()
 	}
 
@@ -105,23 +280,65 @@ func (p *parser) parse() (Template, error) {
 				continue
 			}
 			flushLiteral()
+			start := p.pos
 			tokenContent, err := p.consumeToken()
 			if err != nil {
-				return Template{}, err
+				return Template{}, newParseError(p.input, start, 1, err.Error(), "")
 			}
-			if tokenContent == "" {
-				if hasLine {
-					return Template{}, fmt.Errorf("template contains multiple '{}' placeholders")
+			keyword, condition := splitKeyword(tokenContent)
+			switch keyword {
+			case "if":
+				if condition == "" {
+					return Template{}, p.fail(fmt.Errorf("{if} needs a condition, e.g. {if delta > 2s}"), start, tokenContent)
+				}
+				cond, err := parseCondition(condition)
+				if err != nil {
+					err = shiftSpan(err, strings.Index(tokenContent, condition))
+					return Template{}, p.fail(fmt.Errorf("invalid condition '%s': %w", condition, err), start, tokenContent)
+				}
+				uses |= cond.uses
+				blocks = append(blocks, &ifBlock{cond: cond, start: start, content: tokenContent})
+				continue
+			case "else":
+				if len(blocks) == 0 {
+					return Template{}, p.fail(fmt.Errorf("{else} without a matching {if}"), start, tokenContent)
+				}
+				blk := blocks[len(blocks)-1]
+				if blk.inElse {
+					return Template{}, p.fail(fmt.Errorf("{if} block has more than one {else}"), start, tokenContent)
+				}
+				blk.inElse = true
+				continue
+			case "end":
+				if len(blocks) == 0 {
+					return Template{}, p.fail(fmt.Errorf("{end} without a matching {if}"), start, tokenContent)
 				}
-				hasLine = true
-				segments = append(segments, lineSegment{})
+				blk := blocks[len(blocks)-1]
+				blocks = blocks[:len(blocks)-1]
+				addSegment(ifSegment{cond: blk.cond.cond, then: blk.then, otherwise: blk.otherwise})
 				continue
 			}
-			tokenSeg, err := buildTokenSegment(tokenContent)
+			isLine := isLinePlaceholder(tokenContent)
+			if isLine {
+				if hasLine || branchLine {
+					return Template{}, p.fail(fmt.Errorf("template contains multiple '{}' placeholders"), start, tokenContent)
+				}
+				if len(blocks) > 0 {
+					branchLine = true
+				} else {
+					hasLine = true
+				}
+			}
+			tokenSeg, err := buildTokenSegment(tokenContent, p.cfg)
 			if err != nil {
-				return Template{}, err
+				return Template{}, p.fail(err, start, tokenContent)
 			}
-			segments = append(segments, tokenSeg)
+			if tok, ok := tokenSeg.(tokenSegment); ok {
+				uses |= tok.uses
+				tok.line = isLine
+				tokenSeg = tok
+			}
+			addSegment(tokenSeg)
 		case '}':
 			if p.pos+1 < len(p.input) && p.input[p.pos+1] == '}' {
 				literal.WriteByte('}')
@@ -137,8 +354,36 @@ func (p *parser) parse() (Template, error) {
 	}
 
 	flushLiteral()
+	if len(blocks) > 0 {
+		blk := blocks[len(blocks)-1]
+		return Template{}, p.fail(fmt.Errorf("unterminated {if %s} block; close it with {end}", blk.cond.text), blk.start, blk.content)
+	}
+
+	return Template{segments: segments, hasLinePlaceholder: hasLine, branchLine: branchLine, uses: uses}, nil
+}
+
+// fail converts err, raised by the token whose '{' is at offset start, into a
+// *ParseError. Errors carrying a span point at it; others underline the token.
+func (p *parser) fail(err error, start int, content string) error {
+	var span *spanError
+	if errors.As(err, &span) {
+		return newParseError(p.input, start+1+span.offset, span.length, err.Error(), span.hint)
+	}
+	return newParseError(p.input, start, len(content)+2, err.Error(), "")
+}
 
-	return Template{segments: segments, hasLinePlaceholder: hasLine}, nil
+// splitKeyword recognizes the block keywords if, else and end, returning the
+// keyword and, for if, the condition that follows it. Other tokens return "".
+func splitKeyword(content string) (string, string) {
+	trimmed := strings.TrimSpace(content)
+	switch trimmed {
+	case "if", "else", "end":
+		return trimmed, ""
+	}
+	if rest, ok := strings.CutPrefix(trimmed, "if "); ok {
+		return "if", strings.TrimSpace(rest)
+	}
+	return "", ""
 }
 
 func (p *parser) consumeToken() (string, error) {
@@ -162,80 +407,501 @@ func (p *parser) consumeToken() (string, error) {
 	return "", fmt.Errorf("unterminated '{' in template")
 }
 
-func buildTokenSegment(raw string) (segment, error) {
+// isLinePlaceholder reports whether token content is the {} line placeholder,
+// optionally followed by a format spec such as {:.120} or pipe stages.
+func isLinePlaceholder(content string) bool {
+	return content == "" || content[0] == ':' || content[0] == '|'
+}
+
+// buildTokenSegment parses one token: its name, modifier, and any trailing
+// pipe stages. A quoted stage (|"-") is a default used when the value is empty;
+// any other stage names a filter such as |upper or |truncate:80.
+func buildTokenSegment(content string, cfg Config) (segment, error) {
+	raw, stages, err := splitPipes(content)
+	if err != nil {
+		return nil, err
+	}
+	seg, err := buildToken(raw, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if len(stages) == 0 {
+		return seg, nil
+	}
+	tok, ok := seg.(tokenSegment)
+	if !ok {
+		return nil, fmt.Errorf("token '%s' does not accept defaults or filters", strings.TrimSpace(raw))
+	}
+	for _, pipe := range stages {
+		stage := pipe.text
+		if stage == "" {
+			return nil, &spanError{offset: pipe.offset - 1, length: 1, msg: "empty pipe stage"}
+		}
+		if !strings.HasPrefix(stage, "\"") {
+			fn, err := parseFilter(stage)
+			if err != nil {
+				return nil, shiftSpan(err, pipe.offset)
+			}
+			tok.pipeline = append(tok.pipeline, fn)
+			continue
+		}
+		fallback, err := strconv.Unquote(stage)
+		if err != nil {
+			return nil, &spanError{offset: pipe.offset, length: len(stage), msg: fmt.Sprintf("invalid default %s: %v", stage, err)}
+		}
+		tok.pipeline = append(tok.pipeline, func(value string) string {
+			if value == "" {
+				return fallback
+			}
+			return value
+		})
+	}
+	return tok, nil
+}
+
+// pipeStage is one trimmed |stage of a token and its offset in the token.
+type pipeStage struct {
+	text   string
+	offset int
+}
+
+// splitPipes splits token content into the token itself and the pipe stages
+// that follow it, on '|' characters outside double quotes. In a {time} layout,
+// where '|' may be literal text, the first '|' only starts a pipeline when a
+// default ("...") or a known filter name follows it, so {time:%T|%D} keeps its
+// '|'.
+func splitPipes(content string) (string, []pipeStage, error) {
+	literalPipes := isTimeToken(content)
+	end := -1
+	for i := 0; i < len(content) && end == -1; i++ {
+		switch {
+		case content[i] != '|':
+		case !literalPipes || isPipeStage(content[i+1:]):
+			end = i
+		}
+	}
+	if end == -1 {
+		return content, nil, nil
+	}
+
+	var stages []pipeStage
+	addStage := func(from, to int) {
+		text := strings.TrimLeft(content[from:to], " ")
+		stages = append(stages, pipeStage{text: strings.TrimSpace(text), offset: to - len(text)})
+	}
+	inQuote := false
+	start := end + 1
+	for i := start; i < len(content); i++ {
+		switch content[i] {
+		case '\\':
+			if inQuote {
+				i++
+			}
+		case '"':
+			inQuote = !inQuote
+		case '|':
+			if inQuote {
+				continue
+			}
+			addStage(start, i)
+			start = i + 1
+		}
+	}
+	if inQuote {
+		return "", nil, fmt.Errorf("unterminated string in token '%s'", content)
+	}
+	addStage(start, len(content))
+	return content[:end], stages, nil
+}
+
+// isTimeToken reports whether content is a {time} token, allowing for an
+// @zone suffix on the name.
+func isTimeToken(content string) bool {
+	name, _, _ := strings.Cut(content, ":")
+	name, _, _ = strings.Cut(name, "@")
+	return strings.TrimSpace(name) == "time"
+}
+
+// zoneLikePattern matches IANA names of the Area/Location form, which are
+// reported as unknown zones rather than read as layout text.
+var zoneLikePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_+-]*(/[A-Za-z0-9_+-]+)+$`)
+
+// splitLayoutZone separates a trailing @zone from a {time} argument. The
+// suffix is a zone only when it loads as one or looks like an Area/Location
+// name; otherwise the '@' is layout text, so {time:%H@%M} renders "23@34".
+func splitLayoutZone(arg string) (string, string) {
+	idx := strings.LastIndexByte(arg, '@')
+	if idx == -1 {
+		return arg, ""
+	}
+	zone := strings.TrimSpace(arg[idx+1:])
+	if zone == "" {
+		return arg, ""
+	}
+	if _, err := time.LoadLocation(zone); err != nil && !zoneLikePattern.MatchString(zone) {
+		return arg, ""
+	}
+	return arg[:idx], arg[idx+1:]
+}
+
+// splitTimeSpec separates a trailing ":[[fill]align]width" from a {time}
+// layout, as in {time:15:04:>10}. Only a complete spec at the very end counts,
+// so layouts that merely start or end with '<', '>' or '^' stay literal.
+func splitTimeSpec(arg string) (formatSpec, string, error) {
+	idx := strings.LastIndexByte(arg, ':')
+	if idx == -1 {
+		return formatSpec{}, arg, nil
+	}
+	spec, rest, err := splitAlignSpec(arg[idx+1:])
+	if err != nil {
+		return formatSpec{}, "", err
+	}
+	if spec.align == 0 || spec.width == 0 || rest != "" {
+		return formatSpec{}, arg, nil
+	}
+	return spec, arg[:idx], nil
+}
+
+// isPipeStage reports whether rest, the text after a '|', begins with a default
+// or a registered filter name.
+func isPipeStage(rest string) bool {
+	rest = strings.TrimLeft(rest, " ")
+	if strings.HasPrefix(rest, `"`) {
+		return true
+	}
+	n := 0
+	for n < len(rest) && (rest[n] == '_' || rest[n] >= 'a' && rest[n] <= 'z') {
+		n++
+	}
+	if _, ok := filters[rest[:n]]; !ok {
+		return false
+	}
+	return n == len(rest) || strings.ContainsRune(": |", rune(rest[n]))
+}
+
+func buildToken(raw string, cfg Config) (segment, error) {
 	name := raw
 	arg := ""
 	if idx := strings.IndexRune(raw, ':'); idx != -1 {
 		name = raw[:idx]
 		arg = raw[idx+1:]
 	}
+	zone := ""
+	if n, z, ok := strings.Cut(name, "@"); ok {
+		name, zone = n, z
+	} else if n := strings.TrimSpace(name); n == "iso" {
+		if idx := strings.LastIndexByte(arg, '@'); idx != -1 {
+			arg, zone = arg[:idx], arg[idx+1:]
+		}
+	} else if n == "time" {
+		arg, zone = splitLayoutZone(arg)
+	}
 	name = strings.TrimSpace(name)
 	arg = strings.TrimSpace(arg)
 
+	if isLinePlaceholder(raw) {
+		spec, err := parseFormatSpec(arg, '<')
+		if err != nil {
+			return nil, err
+		}
+		return tokenSegment{eval: func(state StampState) string {
+			return state.LineText
+		}, spec: spec}, nil
+	}
+
 	if name == "" {
 		return nil, fmt.Errorf("empty token in template")
 	}
 
+	loc := cfg.Location
+	if zone != "" {
+		if name != "time" && name != "iso" {
+			return nil, fmt.Errorf("time zone modifier '@%s' only applies to {time} and {iso}", zone)
+		}
+		var err error
+		zone = strings.TrimSpace(zone)
+		loc, err = time.LoadLocation(zone)
+		if err != nil {
+			return nil, &spanError{offset: strings.LastIndex(raw, zone), length: len(zone), msg: fmt.Sprintf("unknown time zone '%s'", zone)}
+		}
+	}
+
 	switch name {
-	case "elapsed":
-		evaluator, err := durationEvaluator(arg, func(state StampState) time.Duration { return state.Elapsed })
+	case "elapsed", "delta", "since", "prev_delta", "idle":
+		spec, modifier, err := splitAlignSpec(arg)
 		if err != nil {
 			return nil, err
 		}
-		return tokenSegment{eval: evaluator}, nil
-	case "delta":
-		evaluator, err := durationEvaluator(arg, func(state StampState) time.Duration { return state.Delta })
+		evaluator, err := durationEvaluator(modifier, durationGetters[name])
 		if err != nil {
 			return nil, err
 		}
-		return tokenSegment{eval: evaluator}, nil
+		seg := tokenSegment{eval: evaluator, spec: spec}
+		if name == "delta" {
+			seg.uses = useDelta
+			if cfg.Color {
+				seg.style = deltaStyle(cfg.WarnDelta, cfg.CritDelta)
+			}
+		}
+		return seg, nil
+	case "since_epoch":
+		if cfg.Epoch.IsZero() {
+			return nil, fmt.Errorf("{since_epoch} needs a reference time; set one with --epoch")
+		}
+		spec, modifier, err := splitAlignSpec(arg)
+		if err != nil {
+			return nil, err
+		}
+		epoch := cfg.Epoch
+		evaluator, err := durationEvaluator(modifier, func(state StampState) time.Duration {
+			return state.Now.Sub(epoch)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return tokenSegment{eval: evaluator, spec: spec}, nil
+	case "timer":
+		timerName, modifier, _ := strings.Cut(arg, ":")
+		timerName = strings.TrimSpace(timerName)
+		if timerName == "" {
+			return nil, fmt.Errorf("timer token requires a name such as {timer:build}")
+		}
+		if !slices.Contains(cfg.Timers, timerName) {
+			return nil, &spanError{offset: strings.LastIndex(raw, timerName), length: len(timerName), hint: suggest(timerName, cfg.Timers),
+				msg: fmt.Sprintf("unknown timer '%s'; define it with --timer %s=REGEX", timerName, timerName)}
+		}
+		spec, modifier, err := splitAlignSpec(modifier)
+		if err != nil {
+			return nil, err
+		}
+		evaluator, err := durationEvaluator(modifier, func(state StampState) time.Duration {
+			return state.Timers[timerName]
+		})
+		if err != nil {
+			return nil, err
+		}
+		return tokenSegment{eval: evaluator, spec: spec}, nil
 	case "time":
-		layout, unixStamp, err := resolveTimeLayout(arg)
+		spec, layoutArg, err := splitTimeSpec(arg)
 		if err != nil {
 			return nil, err
 		}
+		digits := -1
+		if layout, n, ok := splitFractionSuffix(layoutArg); ok {
+			layoutArg, digits = layout, n
+		}
+		format, unixStamp, err := resolveTimeLayout(layoutArg, cfg.Locale, digits)
+		if err != nil {
+			return nil, shiftSpan(err, strings.Index(raw, layoutArg))
+		}
 		if unixStamp {
 			evaluator, err := unixEvaluator("")
 			if err != nil {
 				return nil, err
 			}
-			return tokenSegment{eval: evaluator}, nil
+			return tokenSegment{eval: evaluator, spec: spec}, nil
 		}
 		return tokenSegment{eval: func(state StampState) string {
-			return state.Now.Format(layout)
-		}}, nil
+			return format(inLocation(state.Now, loc))
+		}, spec: spec}, nil
 	case "iso":
-		layout, _, err := resolveTimeLayout("iso")
+		// {iso:ms} and {iso:3:>30} fix the fractional digits ahead of the spec.
+		digits := -1
+		if precision, rest, _ := strings.Cut(arg, ":"); precision != "" {
+			if n, ok := fractionDigits(precision); ok {
+				digits, arg = n, rest
+			}
+		}
+		spec, err := parseFormatSpec(arg, '<')
+		if err != nil {
+			return nil, err
+		}
+		format, _, err := resolveTimeLayout("iso", cfg.Locale, digits)
 		if err != nil {
 			return nil, err
 		}
 		return tokenSegment{eval: func(state StampState) string {
-			return state.Now.Format(layout)
-		}}, nil
+			return format(inLocation(state.Now, loc))
+		}, spec: spec}, nil
 	case "unix":
-		evaluator, err := unixEvaluator(arg)
+		spec, modifier, err := splitAlignSpec(arg)
 		if err != nil {
 			return nil, err
 		}
-		return tokenSegment{eval: evaluator}, nil
+		evaluator, err := unixEvaluator(modifier)
+		if err != nil {
+			return nil, err
+		}
+		return tokenSegment{eval: evaluator, spec: spec}, nil
 	case "line":
+		spec, err := parseFormatSpec(arg, '>')
+		if err != nil {
+			return nil, err
+		}
 		return tokenSegment{eval: func(state StampState) string {
 			return strconv.Itoa(state.Line)
-		}}, nil
+		}, spec: spec}, nil
+	case "host", "pid", "user":
+		align := byte('<')
+		if name == "pid" {
+			align = '>'
+		}
+		spec, err := parseFormatSpec(arg, align)
+		if err != nil {
+			return nil, err
+		}
+		return constantToken(processValues[name](), spec), nil
+	case "offset":
+		spec, err := parseFormatSpec(arg, '>')
+		if err != nil {
+			return nil, err
+		}
+		return tokenSegment{eval: func(state StampState) string {
+			return strconv.FormatInt(state.Offset, 10)
+		}, spec: spec}, nil
+	case "len":
+		unit, modifier, _ := strings.Cut(arg, ":")
+		if unit != "bytes" && unit != "runes" {
+			unit, modifier = "bytes", arg
+		}
+		spec, err := parseFormatSpec(modifier, '>')
+		if err != nil {
+			return nil, err
+		}
+		if unit == "runes" {
+			return tokenSegment{eval: func(state StampState) string {
+				return strconv.Itoa(utf8.RuneCountInString(state.Raw))
+			}, spec: spec}, nil
+		}
+		return tokenSegment{eval: func(state StampState) string {
+			return strconv.Itoa(len(state.Raw))
+		}, spec: spec}, nil
+	case "hash":
+		size, modifier, _ := strings.Cut(arg, ":")
+		if size == "" || strings.Trim(size, "0123456789") != "" {
+			size, modifier = "", arg
+		}
+		hash, err := filters["hash"](size)
+		if err != nil {
+			return nil, err
+		}
+		spec, err := parseFormatSpec(modifier, '<')
+		if err != nil {
+			return nil, err
+		}
+		return tokenSegment{eval: func(state StampState) string {
+			return hash(state.Raw)
+		}, spec: spec}, nil
+	case "run_id":
+		spec, err := parseFormatSpec(arg, '<')
+		if err != nil {
+			return nil, err
+		}
+		return constantToken(cfg.RunID, spec), nil
+	case "seq":
+		spec, err := parseFormatSpec(arg, '>')
+		if err != nil {
+			return nil, err
+		}
+		return tokenSegment{eval: func(state StampState) string {
+			return strconv.FormatInt(state.Seq, 10)
+		}, spec: spec, uses: useSeq}, nil
+	case "env":
+		varName, modifier, _ := strings.Cut(arg, ":")
+		varName = strings.TrimSpace(varName)
+		if varName == "" {
+			return nil, fmt.Errorf("env token requires a variable name such as {env:HOSTNAME}")
+		}
+		spec, err := parseFormatSpec(modifier, '<')
+		if err != nil {
+			return nil, err
+		}
+		return constantToken(os.Getenv(varName), spec), nil
+	case "field":
+		fieldName, modifier, _ := strings.Cut(arg, ":")
+		fieldName = strings.TrimSpace(fieldName)
+		if fieldName == "" {
+			return nil, fmt.Errorf("field token requires a name such as {field:level}")
+		}
+		spec, err := parseFormatSpec(modifier, '<')
+		if err != nil {
+			return nil, err
+		}
+		return tokenSegment{eval: func(state StampState) string {
+			return state.Fields[fieldName]
+		}, spec: spec}, nil
+	case "json":
+		path, modifier, _ := strings.Cut(arg, ":")
+		path = strings.TrimSpace(path)
+		if path == "" {
+			return nil, fmt.Errorf("json token requires a path such as {json:level} or {json:http.status}")
+		}
+		spec, err := parseFormatSpec(modifier, '<')
+		if err != nil {
+			return nil, err
+		}
+		keys := strings.Split(path, ".")
+		return tokenSegment{eval: func(state StampState) string {
+			return jsonString(lookupJSON(state.JSON, keys))
+		}, spec: spec, uses: useJSON}, nil
+	case "color":
+		code, err := ansiSequence(arg)
+		if err != nil {
+			return nil, err
+		}
+		return literalSegment{value: enabled(cfg.Color, code)}, nil
+	case "reset":
+		return literalSegment{value: enabled(cfg.Color, ansiReset)}, nil
 	default:
-		return nil, fmt.Errorf("unknown token '%s'", name)
+		return nil, &spanError{offset: strings.Index(raw, name), length: len(name),
+			msg: fmt.Sprintf("unknown token '%s'", name), hint: suggest(name, tokenNames)}
+	}
+}
+
+// tokenNames lists every token and block keyword, for suggestions.
+var tokenNames = []string{"elapsed", "delta", "since", "prev_delta", "since_epoch", "timer", "idle", "time", "iso", "unix", "line", "offset", "len", "hash", "seq", "run_id", "field", "json", "host", "pid", "user", "env", "color", "reset", "if", "else", "end"}
+
+// durationGetters maps duration token names to the state field they render.
+var durationGetters = map[string]func(StampState) time.Duration{
+	"elapsed":    func(state StampState) time.Duration { return state.Elapsed },
+	"delta":      func(state StampState) time.Duration { return state.Delta },
+	"since":      func(state StampState) time.Duration { return state.Since },
+	"prev_delta": func(state StampState) time.Duration { return state.Since },
+	"idle":       func(state StampState) time.Duration { return state.Idle },
+}
+
+// inLocation converts t to loc, leaving it untouched when loc is nil.
+func inLocation(t time.Time, loc *time.Location) time.Time {
+	if loc == nil {
+		return t
 	}
+	return t.In(loc)
 }
 
 func durationEvaluator(modifier string, getter func(StampState) time.Duration) (tokenEvaluator, error) {
+	switch modifier {
+	case "clock":
+		return func(state StampState) string { return formatClock(getter(state)) }, nil
+	case "human":
+		return func(state StampState) string { return formatHuman(getter(state)) }, nil
+	}
+
+	if unit, prefix, ok := splitDurationUnit(modifier); ok {
+		fmtStr, err := unitFormat(prefix, unit)
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration modifier '%s': %w", modifier, err)
+		}
+		return func(state StampState) string {
+			return fmt.Sprintf(fmtStr, float64(getter(state))/float64(unit.size))
+		}, nil
+	}
+
 	fmtStr := "%.1f"
 	if modifier != "" {
-		if strings.ContainsAny(modifier, "{}") {
-			return nil, fmt.Errorf("invalid duration modifier '%s'", modifier)
+		var ok bool
+		if fmtStr, ok = numericFormat(modifier); !ok {
+			return nil, fmt.Errorf("invalid duration format '%s': want clock, human, a unit such as ms, or [flags][width][.precision] followed by e, f or g, e.g. .3f", modifier)
 		}
-		fmtStr = "%" + modifier
-	} else {
-		fmtStr = "%.1f"
 	}
 
 	return func(state StampState) string {
@@ -244,31 +910,49 @@ func durationEvaluator(modifier string, getter func(StampState) time.Duration) (
 	}, nil
 }
 
-func normalizeLayout(layout string) (string, error) {
-	if strings.Contains(layout, "%") {
-		return convertDateLayout(layout)
-	}
-	return layout, nil
+// timeFormatter renders an absolute time for {time} and {iso}.
+type timeFormatter func(time.Time) string
+
+func goLayout(layout string) timeFormatter {
+	return func(t time.Time) string { return t.Format(layout) }
 }
 
-func resolveTimeLayout(arg string) (layout string, unix bool, err error) {
-	if arg == "" {
-		return time.RFC3339, false, nil
-	}
+// namedLayout resolves the layout keywords accepted by {time}, returning other
+// layouts unchanged.
+func namedLayout(arg string) string {
 	switch strings.ToLower(arg) {
-	case "iso", "iso8601":
-		return time.RFC3339, false, nil
+	case "", "iso", "iso8601":
+		return time.RFC3339
 	case "iso8601nano", "isonano":
-		return time.RFC3339Nano, false, nil
+		return time.RFC3339Nano
+	}
+	return arg
+}
+
+// resolveTimeLayout compiles a {time} layout. digits >= 0 fixes the number of
+// fractional-second digits after the seconds field.
+func resolveTimeLayout(arg string, names *Locale, digits int) (format timeFormatter, unix bool, err error) {
+	switch strings.ToLower(arg) {
 	case "unix", "unixs":
-		return "", true, nil
+		return nil, true, nil
+	}
+	arg = namedLayout(arg)
+	if digits >= 0 {
+		fixed, ok := withFraction(arg, digits)
+		if !ok {
+			return nil, false, fmt.Errorf("layout '%s' has no seconds field for %d fractional digits", arg, digits)
+		}
+		arg = fixed
 	}
 
-	normalized, err := normalizeLayout(arg)
-	if err != nil {
-		return "", false, err
+	if strings.Contains(arg, "%") {
+		compiled, err := compileDateLayout(arg, names)
+		if err != nil {
+			return nil, false, err
+		}
+		return compiled.format, false, nil
 	}
-	return normalized, false, nil
+	return goLayout(arg), false, nil
 }
 
 func unixEvaluator(modifier string) (tokenEvaluator, error) {
@@ -277,10 +961,10 @@ func unixEvaluator(modifier string) (tokenEvaluator, error) {
 			return strconv.FormatInt(state.Now.Unix(), 10)
 		}, nil
 	}
-	if strings.ContainsAny(modifier, "{}") {
-		return nil, fmt.Errorf("invalid unix modifier '%s'", modifier)
+	fmtStr, ok := numericFormat(modifier)
+	if !ok {
+		return nil, fmt.Errorf("invalid unix format '%s': want [flags][width][.precision] followed by e, f or g, e.g. .3f (.0f for whole seconds)", modifier)
 	}
-	fmtStr := "%" + modifier
 	return func(state StampState) string {
 		seconds := float64(state.Now.UnixNano()) / float64(time.Second)
 		// Avoid printing negative zero when time is before epoch.
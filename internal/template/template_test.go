@@ -1,7 +1,12 @@
 package template
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -35,6 +40,15 @@ func TestTemplateRenderVariants(t *testing.T) {
 			},
 			want: "Δ2.2s compile",
 		},
+		{
+			name: "idle seconds",
+			tpl:  "idle {idle:.0f}s",
+			state: StampState{
+				Now:  base,
+				Idle: 30 * time.Second,
+			},
+			want: "idle 30s",
+		},
 		{
 			name: "time go layout",
 			tpl:  "{time:2006-01-02 15:04} {}",
@@ -166,53 +180,802 @@ func TestParseErrors(t *testing.T) {
 	}
 }
 
-func TestConvertDateLayout(t *testing.T) {
-	t.Run("basic datetime", func(t *testing.T) {
-		got, err := convertDateLayout("%Y-%m-%d %H:%M:%S")
-		if err != nil {
-			t.Fatalf("convert failed: %v", err)
+func TestCompileDateLayout(t *testing.T) {
+	// Thursday 2024-07-04 09:05:03.123456789 UTC, ISO week 27.
+	stamp := time.Date(2024, 7, 4, 9, 5, 3, 123456789, time.UTC)
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatalf("load location: %v", err)
+	}
+
+	cases := []struct {
+		name   string
+		layout string
+		at     time.Time
+		want   string
+	}{
+		{name: "basic datetime", layout: "%Y-%m-%d %H:%M:%S", want: "2024-07-04 09:05:03"},
+		{name: "escaped percent", layout: "%%Y", want: "%Y"},
+		{name: "microseconds", layout: "%Y-%m-%dT%H:%M:%S.%fZ", want: "2024-07-04T09:05:03.123456Z"},
+		{name: "microseconds without dot", layout: "%Y-%m-%dT%H:%M:%S%fZ", want: "2024-07-04T09:05:03.123456Z"},
+		{name: "literal digits stay literal", layout: "at 3pm on %d", want: "at 3pm on 04"},
+		{name: "space padded day and hours", layout: "[%e|%k|%l]", want: "[ 4| 9| 9]"},
+		{name: "epoch seconds", layout: "%s", want: "1720083903"},
+		{name: "nanoseconds", layout: "%N", want: "123456789"},
+		{name: "milliseconds", layout: "%S.%3N", want: "03.123"},
+		{name: "fraction digits", layout: "%S%3f %S.%9f %f", want: "03.123 03.123456789 .123456"},
+		{name: "composites", layout: "%F %T|%D|%R|%r", want: "2024-07-04 09:05:03|07/04/24|09:05|09:05:03 AM"},
+		{name: "weekday numbers", layout: "%u %w %a %A", want: "4 4 Thu Thursday"},
+		{name: "sunday weekday numbers", layout: "%u %w", at: time.Date(2024, 7, 7, 0, 0, 0, 0, time.UTC), want: "7 0"},
+		{name: "week numbers", layout: "%U %W %V %G %g", want: "26 27 27 2024 24"},
+		{name: "iso week year rollover", layout: "%G-W%V-%u", at: time.Date(2024, 12, 30, 0, 0, 0, 0, time.UTC), want: "2025-W01-1"},
+		{name: "am pm", layout: "%I %p %P", at: time.Date(2024, 7, 4, 15, 0, 0, 0, time.UTC), want: "03 PM pm"},
+		{name: "midnight twelve hour", layout: "%l%P", at: time.Date(2024, 7, 4, 0, 0, 0, 0, time.UTC), want: "12am"},
+		{name: "zones", layout: "%z %:z %Z", at: stamp.In(newYork), want: "-0400 -04:00 EDT"},
+		{name: "month names and day of year", layout: "%b %h %B %j %C", want: "Jul Jul July 186 20"},
+		{name: "newline and tab", layout: "%H%n%M%t%S", want: "09\n05\t03"},
+		{name: "locale style", layout: "%c", want: "Thu Jul  4 09:05:03 2024"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			compiled, err := compileDateLayout(tc.layout, nil)
+			if err != nil {
+				t.Fatalf("compile failed: %v", err)
+			}
+			at := tc.at
+			if at.IsZero() {
+				at = stamp
+			}
+			if got := compiled.format(at); got != tc.want {
+				t.Fatalf("unexpected rendering: got %q want %q", got, tc.want)
+			}
+		})
+	}
+
+	for _, bad := range []string{"%Q", "%", "%Y-%"} {
+		if _, err := compileDateLayout(bad, nil); err == nil {
+			t.Fatalf("expected error for layout %q", bad)
 		}
-		want := "2006-01-02 15:04:05"
-		if got != want {
-			t.Fatalf("unexpected conversion: got %q want %q", got, want)
+	}
+}
+
+func TestFractionalPrecision(t *testing.T) {
+	stamp := time.Date(2024, 7, 4, 9, 5, 3, 120000000, time.UTC)
+	round := time.Date(2024, 7, 4, 9, 5, 3, 0, time.UTC)
+
+	cases := []struct {
+		template string
+		at       time.Time
+		want     string
+	}{
+		{template: "{iso:ms}", want: "2024-07-04T09:05:03.120Z"},
+		{template: "{iso:ms}", at: round, want: "2024-07-04T09:05:03.000Z"},
+		{template: "{iso:us}", want: "2024-07-04T09:05:03.120000Z"},
+		{template: "{iso:ns}", want: "2024-07-04T09:05:03.120000000Z"},
+		{template: "{iso:2}", want: "2024-07-04T09:05:03.12Z"},
+		{template: "{iso:s}", want: "2024-07-04T09:05:03Z"},
+		{template: "{iso:ms:>26}|", want: "  2024-07-04T09:05:03.120Z|"},
+		{template: "{iso:ms@Asia/Tokyo}", want: "2024-07-04T18:05:03.120+09:00"},
+		{template: "{iso:>22}|", want: "  2024-07-04T09:05:03Z|"},
+		{template: "{time:iso8601nano:ms}", at: round, want: "2024-07-04T09:05:03.000Z"},
+		{template: "{time:15:04:05:.3}", want: "09:05:03.120"},
+		{template: "{time:15:04:05.999999:.4}", want: "09:05:03.1200"},
+		{template: "{time:15:04:5}", want: "09:05:3"},
+		{template: "{time:%T:.3}", want: "09:05:03.120"},
+		{template: "{time:%T:ms}", want: "09:05:03.120"},
+		{template: "{time:%T:us}", want: "09:05:03.120000"},
+		{template: "{time:%F %T.%N:.6}", want: "2024-07-04 09:05:03.120000"},
+		{template: "{time:%T%f:.0}", want: "09:05:03"},
+		{template: "{time:%H:%M:.3}", want: "09:05:.3"},
+		// A bare :N stays part of the layout: in Go layouts 1 is the month.
+		{template: "{time:15:04:05:1}", want: "09:05:03:7"},
+		{template: "{time:%T:3}", want: "09:05:03:3"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.template, func(t *testing.T) {
+			tpl, err := Parse(tc.template)
+			if err != nil {
+				t.Fatalf("parse failed: %v", err)
+			}
+			at := tc.at
+			if at.IsZero() {
+				at = stamp
+			}
+			if got := tpl.Render(StampState{Now: at}); got != tc.want {
+				t.Fatalf("unexpected rendering: got %q want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLocaleDateNames(t *testing.T) {
+	morning := time.Date(2024, 7, 4, 9, 5, 3, 0, time.UTC)
+	evening := time.Date(2024, 3, 10, 21, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		locale string
+		layout string
+		at     time.Time
+		want   string
+	}{
+		{locale: "de", layout: "%a %A %b %B", at: morning, want: "Do Donnerstag Jul Juli"},
+		{locale: "de_DE.UTF-8", layout: "%e. %B", at: evening, want: "10. März"},
+		{locale: "fr", layout: "%A %d %B", at: morning, want: "jeudi 04 juillet"},
+		{locale: "es", layout: "%a %I %p", at: evening, want: "dom 09 p. m."},
+		{locale: "ja-JP", layout: "%B%e日(%a) %p%l時", at: morning, want: "7月 4日(木) 午前 9時"},
+		{locale: "ko", layout: "%A %P", at: evening, want: "일요일 오후"},
+		{locale: "C", layout: "%c", at: morning, want: "Thu Jul  4 09:05:03 2024"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.locale, func(t *testing.T) {
+			names, err := LookupLocale(tc.locale)
+			if err != nil {
+				t.Fatalf("LookupLocale returned error: %v", err)
+			}
+			tpl, err := ParseWithConfig("{time:"+tc.layout+"}", Config{Locale: names})
+			if err != nil {
+				t.Fatalf("parse failed: %v", err)
+			}
+			if got := tpl.Render(StampState{Now: tc.at}); got != tc.want {
+				t.Fatalf("unexpected rendering: got %q want %q", got, tc.want)
+			}
+		})
+	}
+
+	if _, err := LookupLocale("xx_XX"); err == nil || !strings.Contains(err.Error(), "available: de, en") {
+		t.Fatalf("expected unknown locale error, got %v", err)
+	}
+}
+
+func TestColorTokens(t *testing.T) {
+	cfg := Config{Color: true, WarnDelta: time.Second, CritDelta: 5 * time.Second}
+
+	cases := []struct {
+		name  string
+		cfg   Config
+		tpl   string
+		delta time.Duration
+		want  string
+	}{
+		{name: "custom style", cfg: cfg, tpl: "{color:bold,red}ERR{reset} {}", want: "\x1b[1;31mERR\x1b[0m line"},
+		{name: "fast delta uncoloured", cfg: cfg, tpl: "{delta:.1f}", delta: 500 * time.Millisecond, want: "0.5 line"},
+		{name: "warn delta yellow", cfg: cfg, tpl: "{delta:.1f}", delta: 2 * time.Second, want: "\x1b[33m2.0\x1b[0m line"},
+		{name: "crit delta red", cfg: cfg, tpl: "{delta:.1f}", delta: 6 * time.Second, want: "\x1b[31m6.0\x1b[0m line"},
+		{name: "disabled", cfg: Config{WarnDelta: time.Second}, tpl: "{color:red}{delta:.1f}{reset}", delta: 2 * time.Second, want: "2.0 line"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tpl, err := ParseWithConfig(tc.tpl, tc.cfg)
+			if err != nil {
+				t.Fatalf("parse failed: %v", err)
+			}
+			got := tpl.Render(StampState{Delta: tc.delta, LineText: "line"})
+			if got != tc.want {
+				t.Fatalf("render mismatch: got %q want %q", got, tc.want)
+			}
+		})
+	}
+
+	for _, bad := range []string{"{color}", "{color:chartreuse}"} {
+		if _, err := ParseWithConfig(bad, cfg); err == nil {
+			t.Fatalf("expected error for template %q", bad)
 		}
-	})
+	}
+}
 
-	t.Run("escaped percent", func(t *testing.T) {
-		got, err := convertDateLayout("%%Y")
-		if err != nil {
-			t.Fatalf("convert failed: %v", err)
+func TestTimeZoneModifiers(t *testing.T) {
+	base := time.Date(2024, 7, 4, 12, 0, 0, 0, time.UTC)
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatalf("load location: %v", err)
+	}
+
+	cases := []struct {
+		name string
+		cfg  Config
+		tpl  string
+		want string
+	}{
+		{name: "iso zone", tpl: "{iso@America/New_York}", want: "2024-07-04T08:00:00-04:00"},
+		{name: "time layout zone", tpl: "{time:15:04:05@Asia/Tokyo}", want: "21:00:00"},
+		{name: "date layout zone", tpl: "{time:%H:%M@UTC}", want: "12:00"},
+		{name: "literal at in date layout", tpl: "{time:%H@%M}", want: "12@00"},
+		{name: "literal at in go layout", tpl: "{time:user@15:04}", want: "user@12:00"},
+		{name: "trailing at", tpl: "{time:15:04@}", want: "12:00@"},
+		{name: "literal at before zone", tpl: "{time:%H@%M@Asia/Tokyo}", want: "21@00"},
+		{name: "default location", cfg: Config{Location: tokyo}, tpl: "{iso}", want: "2024-07-04T21:00:00+09:00"},
+		{name: "token overrides default", cfg: Config{Location: tokyo}, tpl: "{iso} {iso@UTC}", want: "2024-07-04T21:00:00+09:00 2024-07-04T12:00:00Z"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tpl, err := ParseWithConfig(tc.tpl, tc.cfg)
+			if err != nil {
+				t.Fatalf("parse failed: %v", err)
+			}
+			if got := tpl.Render(StampState{Now: base}); got != tc.want {
+				t.Fatalf("render mismatch: got %q want %q", got, tc.want)
+			}
+		})
+	}
+
+	for _, bad := range []string{"{iso@Mars/Olympus}", "{line@UTC}", "{time:%T@Mars/Olympus}"} {
+		if _, err := Parse(bad); err == nil {
+			t.Fatalf("expected error for template %q", bad)
 		}
-		if got != "%Y" {
-			t.Fatalf("unexpected conversion: got %q want %q", got, "%Y")
+	}
+}
+
+func TestDurationFormats(t *testing.T) {
+	cases := []struct {
+		tpl   string
+		value time.Duration
+		want  string
+	}{
+		{tpl: "{elapsed:clock}", value: time.Hour + 2*time.Minute + 3456*time.Millisecond, want: "01:02:03.456"},
+		{tpl: "{elapsed:clock}", value: 26 * time.Hour, want: "26:00:00.000"},
+		{tpl: "{elapsed:human}", value: 62300 * time.Millisecond, want: "1m2.3s"},
+		{tpl: "{elapsed:human}", value: 3725400 * time.Millisecond, want: "1h2m5.4s"},
+		{tpl: "{elapsed:human}", value: 250400 * time.Microsecond, want: "250ms"},
+		{tpl: "{elapsed:human}", value: 0, want: "0s"},
+		{tpl: "{elapsed:ms}", value: 1234567 * time.Microsecond, want: "1235"},
+		{tpl: "{elapsed:.2ms}", value: 1234567 * time.Microsecond, want: "1234.57"},
+		{tpl: "{elapsed:us}", value: 1500 * time.Nanosecond, want: "2"},
+		{tpl: "{elapsed:s}", value: 1250 * time.Millisecond, want: "1.2"},
+		{tpl: "{elapsed:.3m}", value: 90 * time.Second, want: "1.500"},
+		{tpl: "{elapsed:5.1h}", value: 90 * time.Minute, want: "  1.5"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.tpl, func(t *testing.T) {
+			tpl, err := Parse(tc.tpl)
+			if err != nil {
+				t.Fatalf("parse failed: %v", err)
+			}
+			if got := tpl.Render(StampState{Elapsed: tc.value}); got != tc.want {
+				t.Fatalf("render mismatch: got %q want %q", got, tc.want)
+			}
+		})
+	}
+
+	if _, err := Parse("{delta:x.2ms}"); err == nil {
+		t.Fatalf("expected error for malformed unit modifier")
+	}
+}
+
+func TestFormatSpecs(t *testing.T) {
+	base := time.Date(2024, 7, 4, 12, 0, 0, 0, time.UTC)
+	state := StampState{
+		Now:      base,
+		Delta:    1500 * time.Millisecond,
+		Elapsed:  62 * time.Second,
+		Line:     42,
+		LineText: "héllo world",
+	}
+
+	cases := []struct {
+		tpl  string
+		want string
+	}{
+		{tpl: "[{line:>6}] {}", want: "[    42] héllo world"},
+		{tpl: "[{line:6}] {}", want: "[    42] héllo world"},
+		{tpl: "[{line:<6}] {}", want: "[42    ] héllo world"},
+		{tpl: "[{line:^6}] {}", want: "[  42  ] héllo world"},
+		{tpl: "[{line:06}] {}", want: "[000042] héllo world"},
+		{tpl: "[{line:*>5}] {}", want: "[***42] héllo world"},
+		{tpl: "[{delta:>8.3f}] {}", want: "[   1.500] héllo world"},
+		{tpl: "[{delta:<6}] {}", want: "[1.5   ] héllo world"},
+		{tpl: "[{elapsed:>8human}] {}", want: "[    1m2s] héllo world"},
+		{tpl: "[{unix:>12}] {}", want: "[  1720094400] héllo world"},
+		{tpl: "[{time:15:04:>7}] {}", want: "[  12:00] héllo world"},
+		{tpl: "[{time:%T:ms:*^16}]", want: "[**12:00:00.000**] héllo world"},
+		// Layouts that only start or end with an align character stay literal.
+		{tpl: "{time:<15:04>}", want: "<12:00> héllo world"},
+		{tpl: "{time:^15:04}", want: "^12:00 héllo world"},
+		{tpl: "{time:>>%H:%M}", want: ">>12:00 héllo world"},
+		{tpl: "[{iso:^24}] {}", want: "[  2024-07-04T12:00:00Z  ] héllo world"},
+		{tpl: "{line} {:.5}", want: "42 héllo"},
+		{tpl: "{line} [{:>13}]", want: "42 [  héllo world]"},
+		{tpl: "{line} [{:-^15.5}]", want: "42 [-----héllo-----]"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.tpl, func(t *testing.T) {
+			tpl, err := Parse(tc.tpl)
+			if err != nil {
+				t.Fatalf("parse failed: %v", err)
+			}
+			if got := tpl.Render(state); got != tc.want {
+				t.Fatalf("render mismatch: got %q want %q", got, tc.want)
+			}
+		})
+	}
+
+	for _, bad := range []string{"{line:>6x}", "{:.abc}", "{iso:wide}", "{} {:.3}"} {
+		if _, err := Parse(bad); err == nil {
+			t.Fatalf("expected error for template %q", bad)
 		}
-	})
+	}
 
-	t.Run("microseconds", func(t *testing.T) {
-		got, err := convertDateLayout("%Y-%m-%dT%H:%M:%S.%fZ")
-		if err != nil {
-			t.Fatalf("convert failed: %v", err)
+	// Oversized widths are rejected instead of padding (or overflowing) at
+	// render time.
+	for _, huge := range []string{"{line:>99999999999999999999}", "{:99999999999999999999}", "{delta:>5000.1f}", "{line:4097}"} {
+		_, err := Parse(huge)
+		if err == nil || !strings.Contains(err.Error(), "width must be at most 4096") {
+			t.Fatalf("expected width error for template %q, got %v", huge, err)
 		}
-		want := "2006-01-02T15:04:05.000000Z"
-		if got != want {
-			t.Fatalf("unexpected conversion: got %q want %q", got, want)
+	}
+	if _, err := Parse("{line:>4096}"); err != nil {
+		t.Fatalf("maximum width rejected: %v", err)
+	}
+}
+
+func TestFormatSpecAppliesBeforeColor(t *testing.T) {
+	tpl, err := ParseWithConfig("{delta:>6.1f}", Config{Color: true, WarnDelta: time.Second})
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	got := tpl.Render(StampState{Delta: 2 * time.Second})
+	if want := "\x1b[33m   2.0\x1b[0m"; got != want {
+		t.Fatalf("render mismatch: got %q want %q", got, want)
+	}
+}
+
+func TestFieldTokenAndDefaults(t *testing.T) {
+	state := StampState{
+		Fields:   map[string]string{"level": "WARN", "empty": ""},
+		LineText: "disk low",
+	}
+
+	cases := []struct {
+		tpl  string
+		want string
+	}{
+		{tpl: "[{field:level}] {}", want: "[WARN] disk low"},
+		{tpl: "[{field:level:>6}] {}", want: "[  WARN] disk low"},
+		{tpl: "[{field:missing}] {}", want: "[] disk low"},
+		{tpl: `[{field:missing|"-"}] {}`, want: "[-] disk low"},
+		{tpl: `[{field:empty:<3 | "n/a"}] {}`, want: "[n/a] disk low"},
+		{tpl: `[{field:missing:^5|"|"}] {}`, want: "[  |  ] disk low"},
+		{tpl: `{field:level|"-"} {|"<blank>"}`, want: "WARN disk low"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.tpl, func(t *testing.T) {
+			tpl, err := Parse(tc.tpl)
+			if err != nil {
+				t.Fatalf("parse failed: %v", err)
+			}
+			if got := tpl.Render(state); got != tc.want {
+				t.Fatalf("render mismatch: got %q want %q", got, tc.want)
+			}
+		})
+	}
+
+	for _, bad := range []string{"{field}", `{field:x|"unterminated}`, "{field:x|bare}", `{reset|"x"}`} {
+		if _, err := Parse(bad); err == nil {
+			t.Fatalf("expected error for template %q", bad)
 		}
-	})
+	}
+}
+
+func TestJSONTokens(t *testing.T) {
+	var decoded any
+	if err := json.Unmarshal([]byte(`{"level":"warn","msg":"disk low","http":{"status":503,"ok":false},"tags":["a","b"],"user":null}`), &decoded); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	state := StampState{JSON: decoded, JSONLine: true, LineText: "raw"}
 
-	t.Run("microseconds without dot", func(t *testing.T) {
-		got, err := convertDateLayout("%Y-%m-%dT%H:%M:%S%fZ")
+	cases := []struct {
+		tpl  string
+		want string
+	}{
+		{tpl: "{json:level:<5} {json:msg}", want: "warn  disk low"},
+		{tpl: "{json:http.status} {json:http.ok}", want: "503 false"},
+		{tpl: "{json:tags.1} {json:tags}", want: `b ["a","b"]`},
+		{tpl: `{json:user|"anon"} {json:missing.deep|"-"} {json:tags.9|"?"}`, want: "anon - ?"},
+		{tpl: "{json:http}", want: `{"ok":false,"status":503}`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.tpl, func(t *testing.T) {
+			tpl, err := Parse(tc.tpl)
+			if err != nil {
+				t.Fatalf("parse failed: %v", err)
+			}
+			if !tpl.NeedsJSON() {
+				t.Fatalf("expected template to need JSON")
+			}
+			if got := tpl.Render(state); got != tc.want {
+				t.Fatalf("render mismatch: got %q want %q", got, tc.want)
+			}
+		})
+	}
+
+	// A line that is not JSON is appended as usual.
+	mixed, err := Parse("{line} {json:msg}")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if got := mixed.Render(StampState{Line: 1, LineText: "plain text line"}); got != "1  plain text line" {
+		t.Fatalf("unexpected rendering of a non-JSON line: %q", got)
+	}
+
+	plain, err := Parse("{line} {}")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if plain.NeedsJSON() {
+		t.Fatalf("template without json tokens should not need JSON")
+	}
+	if _, err := Parse("{json}"); err == nil {
+		t.Fatalf("expected error for json token without a path")
+	}
+}
+
+func TestConditionals(t *testing.T) {
+	state := StampState{
+		Delta:    3 * time.Second,
+		Line:     7,
+		LineText: "ERROR disk full",
+		Raw:      "ERROR disk full",
+		Fields:   map[string]string{"user": "ada"},
+	}
+	jsonState := StampState{JSON: map[string]any{"status": float64(503), "level": "warn", "ok": true, "done": "false"}}
+
+	cases := []struct {
+		tpl   string
+		state StampState
+		want  string
+	}{
+		{tpl: "{if delta>2}SLOW {end}{}", state: state, want: "SLOW ERROR disk full"},
+		{tpl: "{if delta > 5s}SLOW {end}{}", state: state, want: "ERROR disk full"},
+		{tpl: "{if delta >= 2500ms && line == 7}!{else}.{end}", state: state, want: "! ERROR disk full"},
+		{tpl: "{if field:user}{field:user}{else}anonymous{end}", state: state, want: "ada ERROR disk full"},
+		{tpl: "{if field:missing}{field:missing}{else}anonymous{end}", state: state, want: "anonymous ERROR disk full"},
+		{tpl: `{if field:user == "ada"}me{end}`, state: state, want: "me ERROR disk full"},
+		{tpl: `{if text =~ "^ERROR"}E{else}I{end} {}`, state: state, want: "E ERROR disk full"},
+		{tpl: `{if !(text !~ "disk") || false}disk{end}`, state: state, want: "disk ERROR disk full"},
+		{tpl: "{if delta > 1}{if line > 10}late{else}early{end}{end}", state: state, want: "early ERROR disk full"},
+		{tpl: "{if line > 5}[{}]{end}", state: state, want: "[ERROR disk full]"},
+		{tpl: "{if line > 10}[{}]{end}", state: state, want: "ERROR disk full"},
+		{tpl: "#{line}{if delta > 5s} {:.5}{end}", state: state, want: "#7 ERROR disk full"},
+		{tpl: "{if delta > 1}{if line > 10}{}{end}{else}x{end}", state: state, want: "ERROR disk full"},
+		{tpl: "{if json:status >= 500}5xx{else}ok{end}", state: jsonState, want: "5xx"},
+		{tpl: `{if json:level == "warn"}W{end}`, state: jsonState, want: "W"},
+		{tpl: "{if json:level > 1}num{else}nan{end}", state: jsonState, want: "nan"},
+		{tpl: "{if json:ok == true}yes{else}no{end}", state: jsonState, want: "yes"},
+		{tpl: "{if true == json:ok}yes{else}no{end}", state: jsonState, want: "yes"},
+		{tpl: "{if json:ok != false}yes{else}no{end}", state: jsonState, want: "yes"},
+		{tpl: "{if false == json:done}yes{else}no{end}", state: jsonState, want: "yes"},
+		{tpl: "{if json:level == true}yes{else}no{end}", state: jsonState, want: "no"},
+		{tpl: "{if json:missing != true}yes{else}no{end}", state: jsonState, want: "no"},
+		{tpl: "{if json:ok == true}yes{else}no{end}", state: StampState{}, want: "no"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.tpl, func(t *testing.T) {
+			tpl, err := Parse(tc.tpl)
+			if err != nil {
+				t.Fatalf("parse failed: %v", err)
+			}
+			if got := tpl.Render(tc.state); got != tc.want {
+				t.Fatalf("render mismatch: got %q want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestConditionErrors(t *testing.T) {
+	cases := []struct {
+		tpl  string
+		want string
+	}{
+		{tpl: `{if delta > "x"}`, want: "cannot compare number 'delta' with string '\"x\"'"},
+		{tpl: "{if delta}x{end}", want: "is a number"},
+		{tpl: "{if delta = 2}x{end}", want: "use '=='"},
+		{tpl: "{if bogus > 1}x{end}", want: "unknown name 'bogus'"},
+		{tpl: "{if delta > 2}x", want: "unterminated {if delta > 2} block"},
+		{tpl: "x{end}", want: "{end} without a matching {if}"},
+		{tpl: "{else}", want: "{else} without a matching {if}"},
+		{tpl: "{if true}a{else}b{else}c{end}", want: "more than one {else}"},
+		{tpl: "{if}x{end}", want: "needs a condition"},
+		{tpl: `{if text =~ "("}x{end}`, want: "invalid regular expression"},
+		{tpl: "{if delta > 2}{}{else}{}{end}", want: "multiple '{}'"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.tpl, func(t *testing.T) {
+			_, err := Parse(tc.tpl)
+			if err == nil {
+				t.Fatalf("expected error")
+			}
+			if !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("error %q does not mention %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestTimeLayoutLiteralPipes(t *testing.T) {
+	state := StampState{Now: time.Date(2024, 7, 4, 9, 5, 3, 0, time.UTC)}
+
+	cases := []struct {
+		tpl  string
+		want string
+	}{
+		{tpl: "{time:%T|%D} x", want: "09:05:03|07/04/24 x"},
+		{tpl: "{time:15:04|05}", want: "09:05|03"},
+		{tpl: "{time:%T | %Y@UTC}", want: "09:05:03 | 2024"},
+		{tpl: "{time:%b|upper}", want: "JUL"},
+		{tpl: "{time:%T|%D|truncate:10}", want: "09:05:03|0"},
+		{tpl: `{time:%T|%D|"-"}`, want: "09:05:03|07/04/24"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.tpl, func(t *testing.T) {
+			tpl, err := Parse(tc.tpl)
+			if err != nil {
+				t.Fatalf("parse failed: %v", err)
+			}
+			if got := tpl.Render(state); got != tc.want {
+				t.Fatalf("render mismatch: got %q want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPipeFilters(t *testing.T) {
+	state := StampState{
+		Line:     4,
+		LineText: "  \x1b[31mError\x1b[0m: Disk Full  ",
+		JSON:     map[string]any{"msg": `say "hi"`},
+		JSONLine: true,
+	}
+
+	cases := []struct {
+		tpl  string
+		want string
+	}{
+		{tpl: "{|strip_ansi|trim}", want: "Error: Disk Full"},
+		{tpl: "{|strip_ansi|trim|upper}", want: "ERROR: DISK FULL"},
+		{tpl: "{|strip_ansi|trim|lower|truncate:5}", want: "error"},
+		{tpl: "{:>7|strip_ansi|trim|truncate:5}", want: "  Error"},
+		{tpl: "{json:msg|quote}", want: `"say \"hi\""`},
+		{tpl: `{json:missing|"none"|upper}`, want: "NONE"},
+		{tpl: `{json:missing|upper|"none"}`, want: "none"},
+		{tpl: "{json:msg|hash}", want: "f65be999"},
+		{tpl: "{json:msg:>6|hash:4}", want: "  f65b"},
+		{tpl: "{json:msg|hash:64|truncate:3}", want: "f65"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.tpl, func(t *testing.T) {
+			tpl, err := Parse(tc.tpl)
+			if err != nil {
+				t.Fatalf("parse failed: %v", err)
+			}
+			if got := tpl.Render(state); got != tc.want {
+				t.Fatalf("render mismatch: got %q want %q", got, tc.want)
+			}
+		})
+	}
+
+	for _, bad := range []string{"{|shout}", "{|truncate}", "{|truncate:-1}", "{|upper:2}", "{|hash:65}", "{line||upper}", "{reset|upper}"} {
+		if _, err := Parse(bad); err == nil {
+			t.Fatalf("expected error for template %q", bad)
+		}
+	}
+}
+
+func TestParseErrorPositions(t *testing.T) {
+	cases := []struct {
+		tpl        string
+		column     int
+		length     int
+		suggestion string
+		excerpt    string
+	}{
+		{tpl: "{elasped:.1f}s {}", column: 2, length: 7, suggestion: "elapsed", excerpt: "  {elasped:.1f}s {}\n   ^^^^^^^\n"},
+		{tpl: "[{time:%F %i}]", column: 11, length: 2, suggestion: "%I"},
+		{tpl: "{time:%L}", column: 7, length: 2, suggestion: "%3N"},
+		{tpl: "x {line", column: 3, length: 1, excerpt: "  x {line\n    ^\n"},
+		{tpl: "{if detla > 2}x{end}", column: 5, length: 5, suggestion: "delta"},
+		{tpl: "{line|trim| uper}", column: 13, length: 4, suggestion: "upper"},
+		{tpl: "{iso@Mars/Base}", column: 6, length: 9},
+		{tpl: "{} {}", column: 4, length: 2},
+		{tpl: "héllo {nope}", column: 8, length: 4, excerpt: "  héllo {nope}\n         ^^^^\n"},
+		{tpl: "a\n{line} {tiem}", column: 9, length: 4, suggestion: "time"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.tpl, func(t *testing.T) {
+			_, err := Parse(tc.tpl)
+			var parseErr *ParseError
+			if !errors.As(err, &parseErr) {
+				t.Fatalf("expected *ParseError, got %v", err)
+			}
+			if parseErr.Column != tc.column || parseErr.Length != tc.length {
+				t.Fatalf("span mismatch: got column %d length %d want column %d length %d (%v)",
+					parseErr.Column, parseErr.Length, tc.column, tc.length, err)
+			}
+			if parseErr.Suggestion != tc.suggestion {
+				t.Fatalf("suggestion mismatch: got %q want %q", parseErr.Suggestion, tc.suggestion)
+			}
+			if tc.excerpt != "" && parseErr.Excerpt() != tc.excerpt {
+				t.Fatalf("excerpt mismatch:\n%s\nwant:\n%s", parseErr.Excerpt(), tc.excerpt)
+			}
+		})
+	}
+
+	_, err := Parse("a\n{line} {tiem}")
+	if want := "unknown token 'tiem' at line 2, column 9 (did you mean 'time'?)"; err.Error() != want {
+		t.Fatalf("unexpected message: got %q want %q", err.Error(), want)
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	cases := map[string]string{
+		"elasped": "elapsed",
+		"idel":    "idle",
+		"lien":    "line",
+		"tim":     "time",
+		"x":       "",
+		"banana":  "",
+	}
+	for name, want := range cases {
+		if got := suggest(name, tokenNames); got != want {
+			t.Fatalf("suggest(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestNumericFormatValidation(t *testing.T) {
+	state := StampState{Elapsed: 1500 * time.Millisecond, Now: time.Unix(12, 500_000_000)}
+	valid := map[string]string{
+		"{elapsed:.3f}":    "1.500",
+		"{elapsed:+08.2f}": "+0001.50",
+		"{elapsed:-6.1f}|": "1.5   |",
+		"{elapsed:.2e}":    "1.50e+00",
+		"{elapsed:g}":      "1.5",
+		"{unix:.1f}":       "12.5",
+		"{unix:E}":         "1.250000E+01",
+	}
+	for tpl, want := range valid {
+		parsed, err := Parse(tpl)
 		if err != nil {
-			t.Fatalf("convert failed: %v", err)
+			t.Fatalf("parse %q failed: %v", tpl, err)
 		}
-		want := "2006-01-02T15:04:05.000000Z"
-		if got != want {
-			t.Fatalf("unexpected conversion: got %q want %q", got, want)
+		if got := parsed.Render(state); got != want {
+			t.Fatalf("render %q: got %q want %q", tpl, got, want)
 		}
-	})
+	}
 
-	t.Run("unsupported directive", func(t *testing.T) {
-		if _, err := convertDateLayout("%Q"); err == nil {
-			t.Fatalf("expected error for unsupported directive")
+	for _, bad := range []string{"{elapsed:d}", "{elapsed:.1}", "{elapsed:1.2.3f}", "{elapsed:.1fs}", "{delta:%f}", "{unix:s}", "{unix:x}", "{unix:.f.}"} {
+		_, err := Parse(bad)
+		if err == nil {
+			t.Fatalf("expected error for template %q", bad)
 		}
-	})
+		if !strings.Contains(err.Error(), "invalid") {
+			t.Fatalf("unclear error for %q: %v", bad, err)
+		}
+	}
+}
+
+func TestProcessTokens(t *testing.T) {
+	t.Setenv("STAMPY_TEST_REGION", "eu-west-1")
+	host, _ := os.Hostname()
+	pid := strconv.Itoa(os.Getpid())
+
+	cases := []struct {
+		tpl  string
+		want string
+	}{
+		{tpl: "{host}", want: host},
+		{tpl: "{pid}", want: pid},
+		{tpl: "[{pid:>10}]", want: "[" + strings.Repeat(" ", 10-len(pid)) + pid + "]"},
+		{tpl: "{env:STAMPY_TEST_REGION}", want: "eu-west-1"},
+		{tpl: "{env:STAMPY_TEST_REGION:.2|upper}", want: "EU"},
+		{tpl: `{env:STAMPY_TEST_UNSET|"local"}`, want: "local"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.tpl, func(t *testing.T) {
+			tpl, err := Parse(tc.tpl)
+			if err != nil {
+				t.Fatalf("parse failed: %v", err)
+			}
+			if got := tpl.Render(StampState{}); got != tc.want {
+				t.Fatalf("render mismatch: got %q want %q", got, tc.want)
+			}
+		})
+	}
+
+	tpl, err := Parse("{user}")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if tpl.Render(StampState{}) == "" && os.Getenv("USER") != "" {
+		t.Fatalf("expected {user} to resolve the current user")
+	}
+	runTpl, err := ParseWithConfig("{run_id}#{seq:03}", Config{RunID: "01ARYZ6S41TSV4RRFFQ69G5FAV"})
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if !runTpl.NeedsSeq() {
+		t.Fatalf("expected {seq} template to need the sequence counter")
+	}
+	if got := runTpl.Render(StampState{Seq: 7}); got != "01ARYZ6S41TSV4RRFFQ69G5FAV#007" {
+		t.Fatalf("unexpected run id render: %q", got)
+	}
+	if _, err := Parse("{env}"); err == nil {
+		t.Fatalf("expected error for {env} without a name")
+	}
+}
+
+func TestLineMetadataTokens(t *testing.T) {
+	state := StampState{Raw: "héllo", Offset: 1024}
+	cases := []struct {
+		tpl  string
+		want string
+	}{
+		{tpl: "{offset}", want: "1024"},
+		{tpl: "{offset:>8}", want: "    1024"},
+		{tpl: "{len}", want: "6"},
+		{tpl: "{len:bytes}", want: "6"},
+		{tpl: "{len:runes}", want: "5"},
+		{tpl: "{len:runes:03}", want: "005"},
+		{tpl: "{hash}", want: "3c48591d"},
+		{tpl: "{hash:4}", want: "3c48"},
+		{tpl: "{hash:4:>6}", want: "  3c48"},
+		{tpl: "{hash:^10}", want: " 3c48591d "},
+	}
+	for _, tc := range cases {
+		t.Run(tc.tpl, func(t *testing.T) {
+			tpl, err := Parse(tc.tpl)
+			if err != nil {
+				t.Fatalf("parse failed: %v", err)
+			}
+			if got := tpl.Render(state); got != tc.want {
+				t.Fatalf("render mismatch: got %q want %q", got, tc.want)
+			}
+		})
+	}
+
+	for _, bad := range []string{"{hash:0}", "{hash:99}", "{len:chars}", "{offset:x}"} {
+		if _, err := Parse(bad); err == nil {
+			t.Fatalf("expected error for template %q", bad)
+		}
+	}
+}
+
+func TestNeedsLookahead(t *testing.T) {
+	cases := map[string]bool{
+		"{iso} {}":                      false,
+		"+{since:.3f}s {prev_delta:ms}": false,
+		"{delta} {}":                    true,
+		"{if delta > 2s}SLOW{end}":      true,
+		"{if since > 2s}SLOW{end}":      false,
+	}
+	for input, want := range cases {
+		tpl, err := Parse(input)
+		if err != nil {
+			t.Fatalf("parse %q failed: %v", input, err)
+		}
+		if got := tpl.NeedsLookahead(); got != want {
+			t.Fatalf("NeedsLookahead(%q) = %v, want %v", input, got, want)
+		}
+	}
+}
+
+func TestSinceEpoch(t *testing.T) {
+	epoch := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tpl, err := ParseWithConfig("{since_epoch:.1f} {since_epoch:clock}", Config{Epoch: epoch})
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	got := tpl.Render(StampState{Now: epoch.Add(90*time.Minute + 1500*time.Millisecond)})
+	if want := "5401.5 01:30:01.500"; got != want {
+		t.Fatalf("render mismatch: got %q want %q", got, want)
+	}
+
+	if _, err := Parse("{since_epoch}"); err == nil || !strings.Contains(err.Error(), "--epoch") {
+		t.Fatalf("expected an error pointing at --epoch, got %v", err)
+	}
 }
@@ -0,0 +1,63 @@
+package internal
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// stopwatch is a named timer configured through --timer NAME=REGEX. Each line
+// matching the pattern restarts it, and {timer:NAME} renders the time since.
+type stopwatch struct {
+	name string
+	re   *regexp.Regexp
+}
+
+// parseTimers compiles NAME=REGEX timer specs. Names must be identifiers and
+// unique.
+func parseTimers(specs []string) ([]stopwatch, error) {
+	timers := make([]stopwatch, 0, len(specs))
+	seen := make(map[string]bool, len(specs))
+	for _, spec := range specs {
+		name, pattern, ok := strings.Cut(spec, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || pattern == "" {
+			return nil, fmt.Errorf("invalid timer '%s' (want NAME=REGEX)", spec)
+		}
+		if err := checkName("timer", name); err != nil {
+			return nil, err
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("timer '%s' is defined more than once", name)
+		}
+		seen[name] = true
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timer pattern for '%s': %w", name, err)
+		}
+		timers = append(timers, stopwatch{name: name, re: re})
+	}
+	return timers, nil
+}
+
+// timerNames lists the names declared by NAME=REGEX specs so templates can
+// reject unknown {timer:NAME} tokens.
+func timerNames(specs []string) []string {
+	names := make([]string, 0, len(specs))
+	for _, spec := range specs {
+		name, _, _ := strings.Cut(spec, "=")
+		names = append(names, strings.TrimSpace(name))
+	}
+	return names
+}
+
+// matchTimers returns the names of the timers that text restarts.
+func matchTimers(timers []stopwatch, text string) []string {
+	var names []string
+	for _, timer := range timers {
+		if timer.re.MatchString(text) {
+			names = append(names, timer.name)
+		}
+	}
+	return names
+}
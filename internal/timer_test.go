@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yiblet/stampy/internal/template"
+)
+
+func TestParseTimersErrors(t *testing.T) {
+	for _, spec := range []string{"noequals", "=pattern", "name=", "bad=(", "a:b=x", "a}=x", "a|b=x", "1st=x", "a-b=x"} {
+		if _, err := parseTimers([]string{spec}); err == nil {
+			t.Errorf("expected error for timer %q", spec)
+		}
+	}
+}
+
+func TestParseTimersRejectsDuplicates(t *testing.T) {
+	if _, err := parseTimers([]string{"step=^Step", "step=^Pulling"}); err == nil || !strings.Contains(err.Error(), "more than once") {
+		t.Fatalf("expected duplicate timer error, got %v", err)
+	}
+}
+
+func TestProcessLinesTimers(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := newFakeClock(base, base.Add(1*time.Second), base.Add(3*time.Second), base.Add(4*time.Second), base.Add(10*time.Second))
+
+	opts := Options{Timers: []string{`step=^Step \d+`, `pull=Pulling`}}
+	cfg := template.Config{Timers: timerNames(opts.Timers)}
+	tpl, err := template.ParseWithConfig("{timer:step:.0f} {timer:pull:.0f} {}", cfg)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+
+	input := "setup\nStep 1/3\nPulling base\nStep 2/3\ndone\n"
+	var output bytes.Buffer
+	if err := processLines(strings.NewReader(input), &output, tpl, opts, clock, nil); err != nil {
+		t.Fatalf("processLines returned error: %v", err)
+	}
+	want := "0 0 setup\n0 1 Step 1/3\n2 0 Pulling base\n0 1 Step 2/3\n6 7 done\n"
+	if output.String() != want {
+		t.Fatalf("unexpected output: got %q want %q", output.String(), want)
+	}
+
+	if _, err := template.ParseWithConfig("{timer:steps}", cfg); err == nil || !strings.Contains(err.Error(), "did you mean 'step'") {
+		t.Fatalf("expected unknown timer error with a suggestion, got %v", err)
+	}
+}
@@ -1,19 +1,40 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"time"
+	_ "time/tzdata" // fall back to embedded zone data when the system has none
 
 	"github.com/alexflint/go-arg"
 
 	"github.com/yiblet/stampy/internal"
+	"github.com/yiblet/stampy/internal/template"
 )
 
 type cliArgs struct {
-	Template *string `arg:"positional" help:"Prefix template built from {elapsed}, {delta}, {time:<layout>}, {line}, and {}"`
-	Input    string  `arg:"-i,--input" help:"Optional input file (defaults to stdin)"`
-	Output   string  `arg:"-o,--output" help:"Optional output file (defaults to stdout)"`
-	JSON     string  `arg:"--json" help:"Enable JSONL mode with specified timestamp key name"`
+	Template          *string       `arg:"positional,env:STAMPY_TEMPLATE" help:"Prefix template built from {elapsed}, {delta}, {time:<layout>}, {line}, and {}, or @preset"`
+	Input             string        `arg:"-i,--input" help:"Optional input file (defaults to stdin)"`
+	Output            string        `arg:"-o,--output" help:"Optional output file (defaults to stdout)"`
+	Delimiter         string        `arg:"--delimiter" placeholder:"SEP" help:"Record separator: lf (default), crlf, nul, or any string with escapes such as \\t"`
+	JSON              string        `arg:"--json,env:STAMPY_JSON" placeholder:"KEY" help:"Enable JSONL mode with specified timestamp key name"`
+	NoJSON            bool          `arg:"--no-json" help:"Stay in text mode even if STAMPY_JSON, a config file or a preset enables JSONL mode"`
+	MetricsListen     string        `arg:"--metrics-listen" placeholder:"ADDR" help:"Serve Prometheus metrics on ADDR (e.g. :9100) at /metrics"`
+	Heartbeat         time.Duration `arg:"--heartbeat" placeholder:"DURATION" help:"Emit a heartbeat line after DURATION without input (e.g. 30s)"`
+	HeartbeatTemplate string        `arg:"--heartbeat-template" placeholder:"TEMPLATE" help:"Template for heartbeat lines (default \"{iso}: ... no output for {idle:.0f}s\")"`
+	IdleTimeout       time.Duration `arg:"--idle-timeout" placeholder:"DURATION" help:"Stop with exit code 3 after DURATION without input"`
+	MaxDuration       time.Duration `arg:"--max-duration" placeholder:"DURATION" help:"Stop with exit code 4 once the run has lasted DURATION"`
+	Color             string        `arg:"--color,env:STAMPY_COLOR" placeholder:"WHEN" help:"Colour output: auto (default), always, or never"`
+	WarnDelta         time.Duration `arg:"--warn-delta" placeholder:"DURATION" default:"1s" help:"Render {delta} in yellow above DURATION"`
+	CritDelta         time.Duration `arg:"--crit-delta" placeholder:"DURATION" default:"5s" help:"Render {delta} in red above DURATION"`
+	Extract           []string      `arg:"--extract,separate" placeholder:"NAME=REGEX" help:"Capture a field from each line for {field:NAME} (repeatable)"`
+	TZ                string        `arg:"--tz,env:STAMPY_TZ" placeholder:"ZONE" help:"Time zone for {time} and {iso} (e.g. UTC, America/New_York; defaults to local)"`
+	Locale            string        `arg:"--locale,env:STAMPY_LOCALE" placeholder:"LOCALE" help:"Language for month and weekday names in {time} directives such as %a and %B (e.g. de, ja)"`
+	Epoch             string        `arg:"--epoch" placeholder:"TIME" help:"Reference time for {since_epoch}, as RFC 3339 or Unix seconds"`
+	StartAt           string        `arg:"--start-at" placeholder:"REGEX" help:"Restart {elapsed} at the first line matching REGEX"`
+	Timers            []string      `arg:"--timer,separate" placeholder:"NAME=REGEX" help:"Stopwatch restarted by lines matching REGEX, rendered by {timer:NAME} (repeatable, unique names)"`
+	SeqFile           string        `arg:"--seq-file" placeholder:"PATH" help:"File that keeps the {seq} counter between runs (default $XDG_STATE_HOME/stampy/seq)"`
 }
 
 func (cliArgs) Description() string {
@@ -21,14 +42,50 @@ func (cliArgs) Description() string {
 
 Template syntax (positional argument):
   - Omit the template to use the default "{iso}: {}".
+  - Use @name for a preset, e.g. @build; see "stampy templates list".
+  - "templates" as the first argument is the subcommand; use "stampy -- templates" for that literal template.
   - Place {} where the original line should appear; if omitted the line is appended after the prefix.
   - Available tokens:
-      {elapsed[:fmt]}  seconds since the first emitted line (fmt defaults to .1f)
+      {elapsed[:fmt]}  seconds since the first emitted line (fmt defaults to .1f),
+                       or since the first line matching --start-at once it appears
+      {timer:<name>[:fmt]}  seconds since the last line matching --timer <name>=<regex>
+                       (since the first line until the pattern first matches)
+      {since_epoch[:fmt]}  seconds since --epoch, a time shared across runs or machines
       {delta[:fmt]}    seconds until the next line; final line always emits 0.0
-      {time:<layout>}  absolute time using Go layouts (2006-01-02), Unix date directives (%Y-%m-%d), named layouts like iso/iso8601/iso8601nano, or the keyword unix
-      {iso}           shortcut for RFC3339 (2006-01-02T15:04:05Z07:00)
+                       (lines are held back until the next one arrives)
+      {since[:fmt]}    seconds since the previous line (alias {prev_delta}); without
+                       {delta} in the template, lines are written immediately
+                       duration fmt may also be clock (01:02:03.456), human (1m2.3s),
+                       or a unit with optional precision: ns, us, ms, s, m, h (e.g. .2ms)
+      {time:<layout>}  absolute time using Go layouts (2006-01-02), date(1) directives (%F %T, %s, %3N, %3f, %V, ...), named layouts like iso/iso8601/iso8601nano, or the keyword unix
+      {iso}            shortcut for RFC3339 (2006-01-02T15:04:05Z07:00)
+      {iso:ms|us|ns|N}, {time:<layout>:.N|ms|us|ns}  fixed fractional-second digits,
+                       zero-padded for aligned, sortable stamps, e.g. {iso:ms} or {time:%T:.3}
+      {time:<layout>@<zone>}, {iso@<zone>}  format in an IANA zone, e.g. {iso@UTC}
       {unix[:fmt]}     seconds since the Unix epoch (default integer seconds)
       {line}           1-based line number
+      {offset}         byte offset of the line in the input
+      {len[:runes]}    line length in bytes (or characters with :runes)
+      {hash[:n]}       first n hex digits (default 8) of the line's SHA-256
+      {seq}            line number that continues across runs (see --seq-file)
+      {run_id}         ULID generated once per invocation
+      {host} {pid} {user}  hostname, stampy's PID and current user, resolved at startup
+      {env:<NAME>}     environment variable NAME at startup, e.g. {env:POD_NAME|"-"}
+      {idle[:fmt]}     seconds without input (heartbeat lines only)
+                       numeric fmt is [flags][width][.precision] then e, f or g, e.g. .3f
+      {field:<name>}   value captured by --extract <name>=<regex>; empty when unmatched
+      {json:<path>}    field of a JSON input line, e.g. {json:http.status} or {json:tags.0};
+                       templates using {json:...} only include the raw line where {} appears
+      {color:<style>}  start ANSI styling, e.g. {color:bold,red}; {reset} ends it
+  - Any token accepts a width/alignment spec [[fill]align][width][.precision]:
+      {line:>6}  {delta:>8.3f}  {line:06}  {:.120} (truncate the line)  {time:15:04:>10}
+    align is < (left), > (right) or ^ (centre); precision truncates text tokens.
+  - Append |"text" to a token to render text when it is empty, e.g. {field:user|"-"}.
+  - Append |filter stages to transform any token, including {}: upper, lower, trim,
+    truncate:N, quote, strip_ansi, hash[:N] (SHA-256 hex prefix), e.g. {|strip_ansi|trim}.
+  - {if <cond>}...{else}...{end} renders a branch conditionally, e.g. {if delta > 2s}SLOW {end}.
+    Conditions compare elapsed, delta, idle, unix, line, text, field:<name> and json:<path>
+    with == != < <= > >= =~ !~ and combine them with && || ! and parentheses.
   - Escape literal braces with {{ and }}.
 
 JSONL mode (--json <name>):
@@ -37,19 +94,115 @@ JSONL mode (--json <name>):
   - Primitives and arrays get wrapped as {"<name>": "stamp", "line": value}
   - Invalid JSON gets wrapped as {"<name>": "stamp", "line": "original"}
 
+Metrics (--metrics-listen <addr>):
+  - Serves Prometheus text-format metrics at http://<addr>/metrics
+  - Exposes line and byte counters, the current line rate, a {delta} histogram,
+    seconds since the last line, and JSONL parse failures
+
+Delimiters (--delimiter lf|crlf|nul|<string>):
+  - lf (default) splits on \n and keeps \r in the text; crlf also strips a \r before \n
+  - nul splits on NUL bytes, e.g. for find -print0 | stampy --delimiter nul | xargs -0
+  - Any other value is a literal separator with escapes such as \t or \x1e
+  - Each output line ends with its input record's terminator
+
+Field extraction (--extract <name>=<regex>, repeatable):
+  - <name> is an identifier (letters, digits, underscores), as are --timer names
+  - The field takes the group named <name>, else the first group, else the whole match
+  - Other named groups in the pattern become fields of their own
+  - In JSONL mode matched fields are added to each object without overwriting keys
+
+Run correlation ({run_id}, {seq}, --seq-file <path>):
+  - {run_id} is the same on every line of one invocation and sorts by start time
+  - {seq} continues numbering from the previous run; the counter is stored in
+    --seq-file (default $XDG_STATE_HOME/stampy/seq or ~/.local/state/stampy/seq)
+  - The file is only read and written when the template uses {seq}; concurrent
+    runs may share it and get distinct numbers
+
+Presets (@name, stampy templates list|show|preview):
+  - Built-ins: @iso @ts @utc @elapsed @incremental @build @syslog @jsonl-ts
+  - User presets live under [presets] in a config file (see below) and replace
+    built-ins of the same name
+  - "stampy templates preview <name-or-template>" renders sample lines with a fixed clock
+
+Configuration (config.toml, .stampy.toml, STAMPY_* variables):
+  - template, json, tz, locale and color set defaults for the template, --json, --tz,
+    --locale and --color
+  - Precedence: flag > STAMPY_TEMPLATE/JSON/TZ/LOCALE/COLOR > project file
+    (nearest .stampy.toml from the working directory up) > user file
+    ($STAMPY_CONFIG, else $XDG_CONFIG_HOME/stampy/config.toml or ~/.config/stampy/config.toml)
+  - --no-json turns off JSONL mode enabled by STAMPY_JSON, a config file or a preset
+  - A config that fails to load is an error only without a template or with @preset;
+    otherwise stampy warns on stderr and ignores it
+
+Time zones (--tz <zone>):
+  - Sets the default zone for {time} and {iso}; a token-level @<zone> overrides it
+  - Zones are IANA names resolved from system tzdata, with an embedded fallback
+
+Locales (--locale <lang>):
+  - Translates %a %A %b %B %h %p %P in {time} layouts; Go layouts stay English
+  - Built in: en de fr es it pt nl ja zh ko; region and encoding suffixes such as
+    de_DE.UTF-8 are accepted
+
+Colour (--color auto|always|never):
+  - {delta} turns yellow above --warn-delta (1s) and red above --crit-delta (5s)
+  - auto colours only when writing to a terminal and NO_COLOR is unset
+  - JSONL output is never coloured
+
+Heartbeats (--heartbeat <duration>):
+  - After <duration> without input, emits a synthetic line from --heartbeat-template
+  - Repeats every <duration> while input stays quiet; {idle} reports the silence so far
+  - A pending line is written first, with {delta} measured up to the heartbeat, so
+    coloured {delta} needs --warn-delta and --crit-delta below <duration>
+  - Text heartbeats start with "stampy: heartbeat " (filter with grep -v '^stampy: heartbeat ');
+    in JSONL mode heartbeats are objects marked with "heartbeat": true
+
+Guards (--idle-timeout <duration>, --max-duration <duration>):
+  - Stop when input has been quiet for too long, or when the run has lasted too long
+  - The pending line is flushed and a final "stampy: ..." marker line is written
+    (JSONL: an object with "guard" and "exit_code"), outside the template
+  - stampy cannot kill a producer that hangs without writing; a shell pipeline
+    still waits for it, so start the producer in the background and kill it
+    once stampy exits (see the README)
+  - Exit codes: 3 for --idle-timeout, 4 for --max-duration, 1 for other errors
+
 Examples:
   stampy                                  # default ISO timestamp template
   stampy "{elapsed:.1f}s Δ{delta:.1f}s {}"  # elapsed + delta timings
   stampy "[{time:%H:%M:%S}] {line}: {}"     # human-readable clock with line numbers
   stampy --json ts "{iso}"                  # JSONL mode with ISO timestamp
+  stampy @incremental                       # preset: seconds since the previous line
+  stampy --metrics-listen :9100             # expose stream metrics for alerting
+  stampy --heartbeat 30s                    # show when a job has gone quiet
+  stampy --idle-timeout 5m                  # fail fast when output stalls
+  stampy '{iso} {json:level:<5} {json:msg}'  # JSONL logs to readable text
+  stampy --extract 'level=^(INFO|WARN|ERROR)' '{field:level:<5|"-"} {}'  # level column
+  stampy "{time:15:04@UTC} {time:15:04@Asia/Tokyo} {}"  # UTC and Tokyo side by side
+  stampy "{color:gray}{iso}{reset} Δ{delta}s {}"  # dim stamps, highlighted slow steps
 `
 }
 
 func (c *cliArgs) toOptions() internal.Options {
 	opts := internal.Options{
-		Input:   c.Input,
-		Output:  c.Output,
-		JSONKey: c.JSON,
+		Input:             c.Input,
+		Output:            c.Output,
+		Delimiter:         c.Delimiter,
+		JSONKey:           c.JSON,
+		NoJSON:            c.NoJSON,
+		MetricsListen:     c.MetricsListen,
+		Heartbeat:         c.Heartbeat,
+		HeartbeatTemplate: c.HeartbeatTemplate,
+		IdleTimeout:       c.IdleTimeout,
+		MaxDuration:       c.MaxDuration,
+		Color:             c.Color,
+		WarnDelta:         c.WarnDelta,
+		CritDelta:         c.CritDelta,
+		Extract:           c.Extract,
+		TZ:                c.TZ,
+		Locale:            c.Locale,
+		SeqFile:           c.SeqFile,
+		Epoch:             c.Epoch,
+		StartAt:           c.StartAt,
+		Timers:            c.Timers,
 	}
 	if c.Template != nil {
 		opts.Template = *c.Template
@@ -58,11 +211,95 @@ func (c *cliArgs) toOptions() internal.Options {
 	return opts
 }
 
-func main() {
+// templatesArgs is the command line of `stampy templates`, which go-arg cannot
+// express as a subcommand alongside the positional template.
+type templatesArgs struct {
+	List    *struct{}    `arg:"subcommand:list" help:"List built-in and user presets"`
+	Show    *showArgs    `arg:"subcommand:show" help:"Print the template of a preset"`
+	Preview *previewArgs `arg:"subcommand:preview" help:"Render sample lines through a preset or template with a fixed clock"`
+}
+
+type showArgs struct {
+	Name string `arg:"positional,required" placeholder:"NAME" help:"Preset name (with or without @)"`
+}
+
+// previewArgs takes the settings that change how a preview renders, from
+// flags, STAMPY_* variables or the config files like a normal run.
+type previewArgs struct {
+	Name   string `arg:"positional,required" placeholder:"NAME" help:"Preset name (with or without @), or a template"`
+	JSON   string `arg:"--json,env:STAMPY_JSON" placeholder:"KEY" help:"Preview JSONL mode with specified timestamp key name"`
+	NoJSON bool   `arg:"--no-json" help:"Preview text mode even if JSONL mode is configured"`
+	TZ     string `arg:"--tz,env:STAMPY_TZ" placeholder:"ZONE" help:"Time zone for {time} and {iso} (default UTC)"`
+	Locale string `arg:"--locale,env:STAMPY_LOCALE" placeholder:"LOCALE" help:"Language for month and weekday names"`
+}
+
+func (templatesArgs) Description() string {
+	return `Inspect template presets, selected with @name in place of a template.
+User presets are read from $XDG_CONFIG_HOME/stampy/config.toml (default ~/.config/stampy/config.toml)
+and from the nearest .stampy.toml, which takes precedence.
+`
+}
+
+// loadConfig reads the user and project config files.
+func loadConfig() (internal.FileConfig, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return internal.FileConfig{}, err
+	}
+	return internal.LoadConfig(dir)
+}
+
+func runTemplates(argv []string) error {
+	var cmd templatesArgs
+	p, err := arg.NewParser(arg.Config{Program: "stampy templates"}, &cmd)
+	if err != nil {
+		return err
+	}
+	p.MustParse(argv)
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	switch {
+	case cmd.Show != nil:
+		return internal.ShowPreset(os.Stdout, cmd.Show.Name, cfg.Presets)
+	case cmd.Preview != nil:
+		opts := internal.Options{JSONKey: cmd.Preview.JSON, NoJSON: cmd.Preview.NoJSON, TZ: cmd.Preview.TZ, Locale: cmd.Preview.Locale}
+		return internal.PreviewTemplate(os.Stdout, cmd.Preview.Name, internal.ApplyConfig(opts, cfg))
+	default:
+		return internal.ListPresets(os.Stdout, cfg.Presets)
+	}
+}
+
+func run() error {
+	if len(os.Args) > 1 && os.Args[1] == "templates" {
+		return runTemplates(os.Args[2:])
+	}
 	var args cliArgs
 	arg.MustParse(&args)
-	if err := internal.Run(args.toOptions()); err != nil {
+	opts := args.toOptions()
+	// A broken config file only stops runs that take their template from it.
+	cfg, err := loadConfig()
+	if err != nil {
+		if internal.NeedsConfig(opts) {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "stampy: ignoring config: %v\n", err)
+	}
+	return internal.Run(internal.ApplyConfig(opts, cfg))
+}
+
+func main() {
+	if err := run(); err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		var parseErr *template.ParseError
+		if errors.As(err, &parseErr) {
+			fmt.Fprint(os.Stderr, parseErr.Excerpt())
+		}
+		var guard *internal.GuardError
+		if errors.As(err, &guard) {
+			os.Exit(guard.Code)
+		}
 		os.Exit(1)
 	}
 }